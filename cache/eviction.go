@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// lru evicts the entry that was used longest ago
+type lru struct {
+	order *list.List
+}
+
+func newLru() *lru {
+	return &lru{order: list.New()}
+}
+
+func (this *lru) add(entry *item) {
+	entry.element = this.order.PushFront(entry)
+}
+
+func (this *lru) touch(entry *item) {
+	if element, ok := entry.element.(*list.Element); ok {
+		this.order.MoveToFront(element)
+	}
+}
+
+func (this *lru) remove(entry *item) {
+	if element, ok := entry.element.(*list.Element); ok {
+		this.order.Remove(element)
+		entry.element = nil
+	}
+}
+
+func (this *lru) victim() *item {
+	back := this.order.Back()
+	if back == nil {
+		return nil
+	}
+	return back.Value.(*item)
+}
+
+// LfuDecay is how many uses per entry, on average, pass before every use count is halved.
+// Without it, entries that were popular once would never be evicted
+const LfuDecay = 8
+
+// lfu evicts the entry with the fewest uses, the oldest first on a tie
+type lfu struct {
+	entries lfuHeap
+	// touches counts the uses since the counts were last halved
+	touches int
+}
+
+func newLfu() *lfu {
+	return &lfu{entries: make(lfuHeap, 0)}
+}
+
+func (this *lfu) add(entry *item) {
+	heap.Push(&this.entries, entry)
+}
+
+func (this *lfu) touch(entry *item) {
+	if entry.index >= 0 && entry.index < len(this.entries) && this.entries[entry.index] == entry {
+		heap.Fix(&this.entries, entry.index)
+	}
+	this.touches++
+	if this.touches >= len(this.entries)*LfuDecay {
+		this.decay()
+	}
+}
+
+// decay halves every use count, so recent uses outweigh old ones
+func (this *lfu) decay() {
+	this.touches = 0
+	for _, entry := range this.entries {
+		entry.uses /= 2
+	}
+	heap.Init(&this.entries)
+}
+
+func (this *lfu) remove(entry *item) {
+	if entry.index >= 0 && entry.index < len(this.entries) && this.entries[entry.index] == entry {
+		heap.Remove(&this.entries, entry.index)
+	}
+}
+
+func (this *lfu) victim() *item {
+	if len(this.entries) == 0 {
+		return nil
+	}
+	return this.entries[0]
+}
+
+type lfuHeap []*item
+
+func (this lfuHeap) Len() int {
+	return len(this)
+}
+
+func (this lfuHeap) Less(i, j int) bool {
+	if this[i].uses == this[j].uses {
+		return this[i].lastUsed < this[j].lastUsed
+	}
+	return this[i].uses < this[j].uses
+}
+
+func (this lfuHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *lfuHeap) Push(value interface{}) {
+	entry := value.(*item)
+	entry.index = len(*this)
+	*this = append(*this, entry)
+}
+
+func (this *lfuHeap) Pop() interface{} {
+	old := *this
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*this = old[:len(old)-1]
+	return entry
+}
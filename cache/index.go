@@ -0,0 +1,248 @@
+// Package cache is a size and memory bounded key value store
+// with LRU or LFU eviction and expiry sweeping
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LRU = "lru"
+	LFU = "lfu"
+)
+
+type Options struct {
+	// MaxEntries and MaxBytes bound the cache, zero means no limit
+	MaxEntries int
+	MaxBytes   int64
+	// Eviction is LRU or LFU, LRU if empty
+	Eviction string
+	// Grace keeps entries around for this long after they expire before Sweep removes them
+	Grace time.Duration
+}
+
+type Stats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Expired   int64 `json:"expired"`
+}
+
+type Cache struct {
+	mutex   sync.Mutex
+	options Options
+	items   map[string]*item
+	evictor evictor
+	bytes   int64
+	stats   Stats
+}
+
+type item struct {
+	key      string
+	value    interface{}
+	size     int64
+	expires  time.Time
+	uses     int64
+	lastUsed int64
+	// index is the position of the item in the evictor
+	index int
+	// element is used by the LRU evictor
+	element interface{}
+}
+
+// evictor decides which item goes first when the cache is full
+type evictor interface {
+	add(*item)
+	touch(*item)
+	remove(*item)
+	victim() *item
+}
+
+func New(options Options) *Cache {
+	return &Cache{
+		options: options,
+		items:   make(map[string]*item),
+		evictor: newEvictor(options.Eviction),
+	}
+}
+
+func newEvictor(eviction string) evictor {
+	if strings.ToLower(eviction) == LFU {
+		return newLfu()
+	}
+	return newLru()
+}
+
+// Configure changes the limits of the cache, evicting entries until it fits
+func (this *Cache) Configure(options Options) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if strings.ToLower(options.Eviction) != strings.ToLower(this.options.Eviction) {
+		this.evictor = newEvictor(options.Eviction)
+		for _, entry := range this.items {
+			entry.element = nil
+			entry.index = -1
+			this.evictor.add(entry)
+		}
+	}
+	this.options = options
+	this.evict()
+}
+
+// Get returns a value that has not expired yet, counting it as a hit or miss
+func (this *Cache) Get(key string) (interface{}, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entry, ok := this.items[key]
+	if !ok || time.Now().After(entry.expires) {
+		this.stats.Misses++
+		return nil, false
+	}
+	this.stats.Hits++
+	this.use(entry)
+	return entry.value, true
+}
+
+// Peek returns a value even if it has expired, along with its expiry,
+// without counting towards the stats or eviction order
+func (this *Cache) Peek(key string) (interface{}, time.Time, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entry, ok := this.items[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return entry.value, entry.expires, true
+}
+
+// Set adds or replaces a value, size is the estimated memory it takes up
+func (this *Cache) Set(key string, value interface{}, size int64, expires time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if entry, ok := this.items[key]; ok {
+		this.bytes += size - entry.size
+		entry.value = value
+		entry.size = size
+		entry.expires = expires
+		this.use(entry)
+	} else {
+		// Make room first, so the new entry is never the one evicted to fit itself
+		this.evictFor(1, size)
+		entry = &item{key: key, value: value, size: size, expires: expires, uses: 1}
+		this.items[key] = entry
+		this.bytes += size
+		entry.lastUsed = time.Now().UnixNano()
+		this.evictor.add(entry)
+	}
+	this.evict()
+}
+
+func (this *Cache) Delete(key string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	entry, ok := this.items[key]
+	if ok {
+		this.remove(entry)
+	}
+	return ok
+}
+
+// DeleteFunc removes every entry the function returns true for, returning how many were removed
+func (this *Cache) DeleteFunc(fn func(key string, value interface{}) bool) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	removed := 0
+	for _, entry := range this.items {
+		if fn(entry.key, entry.value) {
+			this.remove(entry)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (this *Cache) Clear() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.items = make(map[string]*item)
+	this.evictor = newEvictor(this.options.Eviction)
+	this.bytes = 0
+}
+
+// Range calls fn for each entry until it returns false.
+// The cache is locked while fn runs, so fn must not call back into it
+func (this *Cache) Range(fn func(key string, value interface{}, expires time.Time) bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, entry := range this.items {
+		if !fn(entry.key, entry.value, entry.expires) {
+			return
+		}
+	}
+}
+
+// Sweep removes entries that expired more than Grace ago
+func (this *Cache) Sweep() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	cutoff := time.Now().Add(-this.options.Grace)
+	removed := 0
+	for _, entry := range this.items {
+		if entry.expires.Before(cutoff) {
+			this.remove(entry)
+			removed++
+		}
+	}
+	this.stats.Expired += int64(removed)
+	return removed
+}
+
+func (this *Cache) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.items)
+}
+
+func (this *Cache) Stats() Stats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	stats := this.stats
+	stats.Entries = len(this.items)
+	stats.Bytes = this.bytes
+	return stats
+}
+
+func (this *Cache) use(entry *item) {
+	entry.uses++
+	entry.lastUsed = time.Now().UnixNano()
+	this.evictor.touch(entry)
+}
+
+func (this *Cache) remove(entry *item) {
+	delete(this.items, entry.key)
+	this.bytes -= entry.size
+	this.evictor.remove(entry)
+}
+
+// evict drops entries until the cache is within its limits
+func (this *Cache) evict() {
+	this.evictFor(0, 0)
+}
+
+// evictFor drops entries until the given number of entries and bytes can be added within the limits
+func (this *Cache) evictFor(entries int, bytes int64) {
+	for len(this.items) > 0 &&
+		((this.options.MaxEntries > 0 && len(this.items)+entries > this.options.MaxEntries) ||
+			(this.options.MaxBytes > 0 && this.bytes+bytes > this.options.MaxBytes)) {
+		victim := this.evictor.victim()
+		if victim == nil {
+			return
+		}
+		this.remove(victim)
+		this.stats.Evictions++
+	}
+}
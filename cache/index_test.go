@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func fill(cache *Cache, count int, uses int) time.Time {
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("key%d", i)
+		cache.Set(key, i, 1, expires)
+		for j := 0; j < uses; j++ {
+			cache.Get(key)
+		}
+	}
+	return expires
+}
+
+func TestLfuKeepsNewEntries(t *testing.T) {
+	cache := New(Options{MaxEntries: 10, Eviction: LFU})
+	expires := fill(cache, 10, 1)
+	cache.Set("new", "value", 1, expires)
+	if _, ok := cache.Get("new"); !ok {
+		t.Errorf("a new entry should not be evicted to make room for itself")
+	}
+	if cache.Len() != 10 || cache.Stats().Evictions != 1 {
+		t.Errorf("expected 10 entries and 1 eviction, got %+v", cache.Stats())
+	}
+}
+
+func TestLfuDecay(t *testing.T) {
+	cache := New(Options{MaxEntries: 4, Eviction: LFU})
+	expires := fill(cache, 1, 100)
+	// key0 was popular once, the other entries are used steadily from now on
+	for i := 1; i < 4; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), i, 1, expires)
+	}
+	for round := 0; round < 20; round++ {
+		for i := 1; i < 4; i++ {
+			cache.Get(fmt.Sprintf("key%d", i))
+		}
+	}
+	cache.Set("new", "value", 1, expires)
+	if _, _, ok := cache.Peek("key0"); ok {
+		t.Errorf("an entry that is no longer used should age out")
+	}
+}
+
+func TestLruEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := New(Options{MaxEntries: 3})
+	expires := fill(cache, 3, 0)
+	cache.Get("key0")
+	cache.Set("new", "value", 1, expires)
+	if _, _, ok := cache.Peek("key1"); ok {
+		t.Errorf("key1 was used longest ago and should have been evicted")
+	}
+	for _, key := range []string{"key0", "key2", "new"} {
+		if _, _, ok := cache.Peek(key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	cache := New(Options{MaxBytes: 100})
+	expires := time.Now().Add(time.Hour)
+	cache.Set("a", 1, 60, expires)
+	cache.Set("b", 2, 60, expires)
+	if _, _, ok := cache.Peek("a"); ok || cache.Stats().Bytes != 60 {
+		t.Errorf("expected only b to fit, got %+v", cache.Stats())
+	}
+	cache.Set("b", 3, 30, expires)
+	if stats := cache.Stats(); stats.Bytes != 30 || stats.Entries != 1 {
+		t.Errorf("replacing an entry should update its size, got %+v", stats)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	cache := New(Options{Grace: time.Minute})
+	cache.Set("old", 1, 1, time.Now().Add(-2*time.Minute))
+	cache.Set("stale", 2, 1, time.Now().Add(-time.Second))
+	cache.Set("fresh", 3, 1, time.Now().Add(time.Minute))
+	if _, ok := cache.Get("stale"); ok {
+		t.Errorf("Get should not return expired entries")
+	}
+	if _, _, ok := cache.Peek("stale"); !ok {
+		t.Errorf("Peek should return expired entries")
+	}
+	if removed := cache.Sweep(); removed != 1 {
+		t.Errorf("Sweep should only remove entries past the grace period, removed %d", removed)
+	}
+	if removed := cache.DeleteFunc(func(key string, value interface{}) bool { return key == "fresh" }); removed != 1 || cache.Len() != 1 {
+		t.Errorf("DeleteFunc removed %d, %d left", removed, cache.Len())
+	}
+}
+
+func TestConfigureSwitchesEviction(t *testing.T) {
+	cache := New(Options{MaxEntries: 5})
+	fill(cache, 5, 0)
+	cache.Configure(Options{MaxEntries: 2, Eviction: LFU})
+	if cache.Len() != 2 {
+		t.Errorf("expected the cache to shrink to 2 entries, got %d", cache.Len())
+	}
+}
@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/logging"
+	"gitlab.com/kamackay/dns/server"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+func serve(args []string) int {
+	flags, options := newFlags("serve", "", "info")
+	var udp, tcp, both, http addresses
+	overrides := &server.Overrides{}
+	flags.Var(&udp, "udp", "Serve DNS over UDP on this address, like :53, 127.0.0.1:53 or eth0:53, can be repeated")
+	flags.Var(&tcp, "tcp", "Serve DNS over TCP on this address, can be repeated")
+	flags.Var(&both, "listen", "Serve DNS over UDP and TCP on this address, can be repeated")
+	flags.Var(&http, "http", "Serve the HTTP API on this address, can be repeated")
+	flags.BoolVar(&overrides.Ipv4Only, "4", false, "Only listen on IPv4")
+	flags.BoolVar(&overrides.Ipv6Only, "6", false, "Only listen on IPv6")
+	args, code, ok := parse(flags, options, args)
+	if !ok {
+		return code
+	} else if !expect(flags, args, 0) {
+		return 2
+	}
+	if overrides.Ipv4Only && overrides.Ipv6Only {
+		fmt.Fprintln(os.Stderr, "-4 and -6 can not be used together")
+		return 2
+	}
+	overrides.ConfigFile = options.config
+	overrides.Udp = append(udp, both...)
+	overrides.Tcp = append(tcp, both...)
+	overrides.Http = http
+
+	logger := logging.GetLogger()
+	logger.Infof("Starting...")
+	srvr := server.New(overrides)
+	if srvr == nil {
+		return 1
+	}
+	servers, err := srvr.ListenDns()
+	if err != nil {
+		logger.Errorf("Failed to listen for DNS %s", err.Error())
+		return 1
+	}
+	srvr.PreStart()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Infof("Shutting Down...")
+		// Queries still being answered are logged, so the query log is only closed once they are done
+		for _, dns := range servers {
+			_ = dns.Shutdown()
+		}
+		srvr.Shutdown()
+		os.Exit(0)
+	}()
+	if err := srvr.ServeDns(servers); err != nil {
+		logger.Errorf("Failed to serve DNS %s", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func checkConfig(args []string) int {
+	flags, options := newFlags("check-config", "", "info")
+	args, code, ok := parse(flags, options, args)
+	if !ok {
+		return code
+	} else if !expect(flags, args, 0) {
+		return 2
+	}
+	problems, err := server.CheckConfig(options.config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", options.config, err.Error())
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s is valid\n", options.config)
+		return 0
+	}
+	fmt.Printf("%s has %d problem(s):\n", options.config, len(problems))
+	for _, problem := range problems {
+		if problem.Value != "" {
+			fmt.Printf("  %s: %q %s\n", problem.Field, problem.Value, problem.Message)
+		} else {
+			fmt.Printf("  %s: %s\n", problem.Field, problem.Message)
+		}
+	}
+	return 1
+}
+
+// lookup are the flags for asking how a name would be answered
+type lookup struct {
+	flags   *flag.FlagSet
+	options *common
+	qtype   string
+	client  string
+	id      string
+	offline bool
+	json    bool
+}
+
+func newLookup(name string, arguments string) *lookup {
+	// Lookups log at warn, so the answer is not lost among what loading the filter lists logs
+	flags, options := newFlags(name, arguments, "warn")
+	settings := &lookup{flags: flags, options: options}
+	flags.StringVar(&settings.qtype, "type", "A", "The query type")
+	flags.StringVar(&settings.client, "client", "127.0.0.1", "Ask as the client with this IP address, which picks its group")
+	flags.StringVar(&settings.id, "id", "", "Ask as the client with this client ID")
+	flags.BoolVar(&settings.offline, "offline", false, "Do not pull the block list")
+	flags.BoolVar(&settings.json, "json", false, "Print the trace as JSON")
+	return settings
+}
+
+// parse reads the flags and the name to look up
+func (this *lookup) parse(args []string) (string, int, bool) {
+	args, code, ok := parse(this.flags, this.options, args)
+	if !ok {
+		return "", code, false
+	} else if !expect(this.flags, args, 1) {
+		return "", 2, false
+	}
+	return args[0], 0, true
+}
+
+// explain loads the config and explains the name, the trace is nil with the exit code if that fails
+func (this *lookup) explain(name string, resolve bool) (*server.Trace, int) {
+	qtype, ok := dns.StringToType[strings.ToUpper(this.qtype)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown query type %s\n", this.qtype)
+		return nil, 2
+	}
+	ip := net.ParseIP(this.client)
+	if ip == nil {
+		fmt.Fprintf(os.Stderr, "Invalid client address %s\n", this.client)
+		return nil, 2
+	}
+	srvr, err := server.Load(&server.Overrides{ConfigFile: this.options.config})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load %s: %s\n", this.options.config, err.Error())
+		return nil, 1
+	}
+	if !this.offline {
+		srvr.PullBlockList()
+	}
+	return srvr.Explain(name, qtype, ip, this.id, resolve), 0
+}
+
+func query(args []string) int {
+	settings := newLookup("query", "<name>")
+	name, code, ok := settings.parse(args)
+	if !ok {
+		return code
+	}
+	trace, code := settings.explain(name, true)
+	if trace == nil {
+		return code
+	} else if settings.json {
+		return printJson(trace)
+	}
+	printSteps(trace)
+	switch {
+	case trace.Answer != nil && trace.Error == "":
+		answer := trace.Answer.Ip
+		if len(trace.Answer.Cnames) > 0 {
+			answer = strings.Join(trace.Answer.Cnames, " -> ") + " " + answer
+		}
+		from := trace.Answer.Server
+		if from == "" {
+			from = "hosts"
+		}
+		fmt.Printf("\nAnswer: %s from %s (%s)\n", answer, from, trace.Result)
+	case trace.Error != "":
+		fmt.Printf("\nAnswer: none (%s), %s\n", trace.Result, trace.Error)
+	default:
+		fmt.Printf("\nAnswer: none (%s)\n", trace.Result)
+	}
+	return 0
+}
+
+func blocklist(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintf(os.Stderr, "Usage: server blocklist test [flags] <domain>\n")
+		return 2
+	}
+	settings := newLookup("blocklist test", "<domain>")
+	name, code, ok := settings.parse(args[1:])
+	if !ok {
+		return code
+	}
+	trace, code := settings.explain(name, false)
+	if trace == nil {
+		return code
+	} else if settings.json {
+		return printJson(trace)
+	}
+	fmt.Printf("%s for %s in group %s\n\n", trace.Name, trace.Client, trace.Group)
+	if len(trace.Matches) == 0 {
+		fmt.Println("No rules match")
+	} else {
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "SOURCE\tRULE\tKIND")
+		for _, match := range trace.Matches {
+			kind := "block"
+			if match.Exception {
+				kind = "allow"
+			}
+			if match.Best {
+				kind += ", wins"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\n", match.Source, match.Rule, kind)
+		}
+		_ = table.Flush()
+	}
+	verdict := "Not blocked"
+	if trace.Result == server.ResultBlocked {
+		verdict = "Blocked"
+	}
+	for _, step := range trace.Steps {
+		if step.Decided {
+			verdict += ", " + step.Check + ": " + step.Detail
+		}
+	}
+	fmt.Printf("\n%s\n", verdict)
+	return 0
+}
+
+func printSteps(trace *server.Trace) {
+	fmt.Printf("%s %s for %s in group %s\n\n", trace.Name, trace.Type, trace.Client, trace.Group)
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, step := range trace.Steps {
+		marker := " "
+		if step.Decided {
+			marker = ">"
+		}
+		fmt.Fprintf(table, "%s %s\t%s\n", marker, step.Check, step.Detail)
+	}
+	_ = table.Flush()
+}
+
+func printJson(trace *server.Trace) int {
+	data, err := jsoniter.MarshalIndent(trace, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println(string(data))
+	return 0
+}
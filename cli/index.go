@@ -0,0 +1,111 @@
+// Package cli is the command line, which serves DNS by default and has commands
+// to check the config and to see how a name would be answered without a running server
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"gitlab.com/kamackay/dns/logging"
+	"gitlab.com/kamackay/dns/server"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: server [command] [flags]
+
+Commands:
+  serve                    Serve DNS and the HTTP API, the default when no command is given
+  check-config             Check the config file and exit
+  query <name>             Look a name up through the configured filters and upstreams, showing each decision
+  blocklist test <domain>  Show the rules matching a domain and whether it is blocked
+
+Run server <command> -h for the flags of a command.
+`
+
+// addresses is a flag that can be given more than once
+type addresses []string
+
+func (this *addresses) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *addresses) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
+
+// common are the flags every command has
+type common struct {
+	config   string
+	logLevel string
+}
+
+// Run runs the command in args, which leave out the program name, and returns the exit code
+func Run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return serve(args)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve(args)
+	case "check-config":
+		return checkConfig(args)
+	case "query":
+		return query(args)
+	case "blocklist":
+		return blocklist(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+	return 2
+}
+
+// newFlags makes the flags for a command, with the common ones logging at level unless told otherwise
+func newFlags(name string, arguments string, level string) (*flag.FlagSet, *common) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	options := &common{}
+	flags.StringVar(&options.config, "config", server.DefaultConfigFile, "The config file to read")
+	flags.StringVar(&options.logLevel, "log-level", level, "Log at this level: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: server %s [flags] %s\n\nFlags:\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags, options
+}
+
+// parse reads the flags, which may come before or after the other arguments, and returns the other arguments.
+// The exit code is set when the command should stop, 0 when only help was asked for
+func parse(flags *flag.FlagSet, options *common, args []string) ([]string, int, bool) {
+	positional := make([]string, 0)
+	for {
+		if err := flags.Parse(args); err == flag.ErrHelp {
+			return nil, 0, false
+		} else if err != nil {
+			return nil, 2, false
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if err := logging.SetLevel(options.logLevel); err != nil {
+		fmt.Fprintln(flags.Output(), err.Error())
+		return nil, 2, false
+	}
+	return positional, 0, true
+}
+
+// expect checks the number of arguments, showing the command's usage if it is wrong
+func expect(flags *flag.FlagSet, args []string, count int) bool {
+	if len(args) == count {
+		return true
+	}
+	fmt.Fprintf(flags.Output(), "Expected %d argument(s), got %d\n", count, len(args))
+	flags.Usage()
+	return false
+}
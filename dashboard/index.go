@@ -0,0 +1,102 @@
+// Package dashboard is the web page served at /dashboard. It is kept in Go strings,
+// so the binary needs no template files, and loads nothing from outside the server
+package dashboard
+
+import "strings"
+
+const ContentType = "text/html; charset=utf-8"
+
+// Page is the whole dashboard, with its style and script inlined
+var Page = strings.NewReplacer("{{style}}", style, "{{script}}", script).Replace(page)
+
+const page = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>DNS Dashboard</title>
+<style>{{style}}</style>
+</head>
+<body>
+<header>
+  <h1>DNS</h1>
+  <span id="running"></span>
+  <span id="error" class="bad"></span>
+</header>
+<main>
+  <section class="cards">
+    <div class="card"><label>Queries</label><b id="queries">-</b></div>
+    <div class="card"><label>Cached</label><b id="cached">-</b></div>
+    <div class="card"><label>Blocked</label><b id="blocked">-</b></div>
+    <div class="card"><label>Failed</label><b id="failed">-</b></div>
+    <div class="card"><label>Cache Hit Ratio</label><b id="hitRatio">-</b></div>
+    <div class="card"><label>Cache Entries</label><b id="cacheEntries">-</b></div>
+  </section>
+
+  <section class="panel wide">
+    <h2>Queries per Minute <small>last hour</small></h2>
+    <canvas id="rates" height="180"></canvas>
+    <div class="legend"><span class="queries">Queries</span><span class="cachedKey">Cached</span><span class="blockedKey">Blocked</span></div>
+  </section>
+
+  <section class="panel">
+    <h2>Top Domains <small>last hour</small></h2>
+    <table id="topDomains"></table>
+  </section>
+  <section class="panel">
+    <h2>Top Clients</h2>
+    <table id="topClients"></table>
+  </section>
+  <section class="panel">
+    <h2>Top Blocked</h2>
+    <table id="topBlocked"></table>
+  </section>
+
+  <section class="panel">
+    <h2>Block Lists</h2>
+    <table id="blockLists"></table>
+  </section>
+  <section class="panel">
+    <h2>Upstreams</h2>
+    <table id="upstreams"></table>
+  </section>
+
+  <section class="panel wide">
+    <h2>Query Log</h2>
+    <form id="logSearch" class="row">
+      <input name="domain" placeholder="domain or *.example.com">
+      <input name="client" placeholder="client">
+      <select name="result">
+        <option value="">any result</option>
+        <option>cached</option><option>forwarded</option><option>blocked</option>
+        <option>failed</option><option>stale</option><option>unsupported</option>
+      </select>
+      <button>Search</button>
+      <label><input type="checkbox" id="live"> Live</label>
+    </form>
+    <table id="queryLog"></table>
+    <button id="more" hidden>More</button>
+  </section>
+
+  <section class="panel">
+    <h2>Hosts</h2>
+    <form id="hostForm" class="row">
+      <input name="name" placeholder="name, like nas.local" required>
+      <input name="target" placeholder="IP address or CNAME" required>
+      <button>Save</button>
+    </form>
+    <table id="hosts"></table>
+  </section>
+  <section class="panel">
+    <h2>Blocks</h2>
+    <form id="blockForm" class="row">
+      <input name="name" placeholder="name, like *.ads.example.com" required>
+      <button>Block</button>
+    </form>
+    <table id="blocks"></table>
+  </section>
+</main>
+<script>{{script}}</script>
+</body>
+</html>
+`
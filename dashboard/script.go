@@ -0,0 +1,322 @@
+package dashboard
+
+// script must not use template literals, since it lives in a Go raw string
+const script = `
+"use strict";
+var RefreshEvery = 10000;
+var LogPage = 50;
+
+function $(id) { return document.getElementById(id); }
+
+function escape(value) {
+  return String(value === undefined || value === null ? "" : value).replace(/[&<>"']/g, function (c) {
+    return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+  });
+}
+
+function number(value) { return (value || 0).toLocaleString(); }
+
+function time(millis) { return millis ? new Date(millis).toLocaleTimeString() : "never"; }
+
+function showError(err) { $("error").textContent = err ? String(err.message || err) : ""; }
+
+// authHeader is the token or user and password the API was last signed in with,
+// kept for this tab only so a password is not left behind in the browser
+var authHeader = sessionStorage.getItem("dnsAuth") || "";
+
+function headers() {
+  // Stops the browser asking for a password itself, signIn asks instead
+  var sent = { "X-Requested-With": "dashboard" };
+  if (authHeader) { sent["Authorization"] = authHeader; }
+  return sent;
+}
+
+// signIn asks for a token, or a user and password, and reports whether one was given.
+// Once it is cancelled, it does not ask again until the page is reloaded
+var declined = false;
+function signIn() {
+  var value = declined ? "" : prompt("Sign in with an API token, or user:password");
+  if (!value) {
+    declined = true;
+    return false;
+  }
+  authHeader = value.indexOf(":") > 0 ? "Basic " + btoa(value) : "Bearer " + value;
+  sessionStorage.setItem("dnsAuth", authHeader);
+  return true;
+}
+
+function request(method, url, body, retried) {
+  var sent = authHeader;
+  var options = { method: method, headers: headers() };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  return fetch(url, options).then(function (response) {
+    if (response.status === 204) { return null; }
+    return response.json().then(function (data) {
+      if (!response.ok) {
+        // Validation errors list each rejected field
+        var message = data.errors ? data.errors.map(function (e) {
+          return e.field + " " + e.message;
+        }).join(", ") : data.error;
+        var err = new Error(message || response.statusText);
+        err.status = response.status;
+        throw err;
+      }
+      return data;
+    });
+  }).catch(function (err) {
+    if (err.status !== 401 || retried) { throw err; }
+    // Another request may have signed in already
+    if (authHeader === sent && !signIn()) { throw err; }
+    return request(method, url, body, true);
+  });
+}
+
+function get(url) { return request("GET", url); }
+
+// table fills a table from rows of cells, a cell is text or {html, num}
+function table(id, headers, rows) {
+  var html = "<tr>" + headers.map(function (h) { return "<th>" + escape(h) + "</th>"; }).join("") + "</tr>";
+  if (rows.length === 0) {
+    html += "<tr><td colspan=\"" + headers.length + "\">Nothing yet</td></tr>";
+  }
+  rows.forEach(function (row) {
+    html += "<tr>" + row.map(function (cell) {
+      if (cell !== null && typeof cell === "object") {
+        return "<td" + (cell.num ? " class=\"num\"" : "") + ">" + (cell.html !== undefined ? cell.html : escape(cell.text)) + "</td>";
+      }
+      return "<td>" + escape(cell) + "</td>";
+    }).join("") + "</tr>";
+  });
+  $(id).innerHTML = html;
+}
+
+function num(value) { return { text: number(value), num: true }; }
+
+function loadStatus() {
+  return get("/status").then(function (status) {
+    $("running").textContent = "up " + status.running;
+    $("queries").textContent = number(status.totalRequests);
+    $("cached").textContent = number(status.cachedRequests);
+    $("blocked").textContent = number(status.blockedRequests);
+    $("failed").textContent = number(status.failedRequests);
+    var lookups = status.cache.hits + status.cache.misses;
+    $("hitRatio").textContent = lookups ? (100 * status.cache.hits / lookups).toFixed(1) + "%" : "-";
+    $("cacheEntries").textContent = number(status.cache.entries);
+    var lists = [["Pulled block list", num(status.blockList.rules), status.blockList.pulled ? time(status.blockList.pulled) : "not yet"]];
+    status.groups.forEach(function (group) {
+      lists.push(["Group " + group.name, num(group.rules), number(group.blocks) + " blocks"]);
+    });
+    lists.push(["Local hosts", num(status.hosts), ""]);
+    if (status.activeSchedules.length) {
+      lists.push(["Active schedules", { text: status.activeSchedules.join(", ") }, ""]);
+    }
+    table("blockLists", ["List", "Rules", ""], lists);
+    table("upstreams", ["Server", "Queries", "Errors", "Latency", "Status"], status.upstreams.map(function (upstream) {
+      var state = upstream.healthy
+        ? "<span class=\"good\">ok</span>"
+        : "<span class=\"bad\" title=\"" + escape(upstream.lastError) + "\">failing since " + escape(time(upstream.lastFailure)) + "</span>";
+      return [upstream.server, num(upstream.queries), num(upstream.errors),
+        { text: upstream.latencyMs.toFixed(1) + " ms", num: true }, { html: state }];
+    }));
+  });
+}
+
+function loadHistory() {
+  return get("/history?resolution=minute&from=" + (Date.now() - 3600000)).then(function (history) {
+    drawRates(history.buckets);
+    var domains = Object.keys(history.totals.domains || {}).map(function (name) {
+      return [name, history.totals.domains[name]];
+    }).sort(function (a, b) { return b[1] - a[1]; }).slice(0, 10);
+    table("topDomains", ["Domain", "Queries"], domains.map(function (d) { return [d[0], num(d[1])]; }));
+  });
+}
+
+function loadTop() {
+  return Promise.all([get("/top/clients"), get("/top/blocked")]).then(function (results) {
+    table("topClients", ["Client", "Group", "Queries", "Blocked"], results[0].map(function (c) {
+      return [c.name ? c.name + " (" + c.client + ")" : c.client, c.group, num(c.queries), num(c.blocked)];
+    }));
+    table("topBlocked", ["Domain", "Blocked"], results[1].map(function (d) { return [d.domain, num(d.count)]; }));
+  });
+}
+
+function drawRates(buckets) {
+  var canvas = $("rates");
+  var ratio = window.devicePixelRatio || 1;
+  canvas.width = canvas.clientWidth * ratio;
+  canvas.height = 180 * ratio;
+  var context = canvas.getContext("2d");
+  context.scale(ratio, ratio);
+  var width = canvas.clientWidth, height = 180, pad = 24;
+  var colors = getComputedStyle(document.documentElement);
+  context.clearRect(0, 0, width, height);
+  var max = 1;
+  buckets.forEach(function (b) { max = Math.max(max, b.queries); });
+  context.fillStyle = colors.getPropertyValue("--muted");
+  context.fillText(number(max), 2, 10);
+  context.fillText("0", 2, height - pad + 4);
+  if (buckets.length === 0) { return; }
+  var step = (width - pad) / Math.max(buckets.length - 1, 1);
+  [["queries", "--queries"], ["cached", "--cached"], ["blocked", "--blocked"]].forEach(function (series) {
+    context.strokeStyle = colors.getPropertyValue(series[1]);
+    context.lineWidth = 1.5;
+    context.beginPath();
+    buckets.forEach(function (b, i) {
+      var x = pad + i * step, y = height - pad - (height - pad - 12) * b[series[0]] / max;
+      if (i === 0) { context.moveTo(x, y); } else { context.lineTo(x, y); }
+    });
+    context.stroke();
+  });
+}
+
+// Query log search, with a cursor for the next page
+var logQuery = "";
+var logNext = "";
+var logRows = [];
+var stream = null;
+
+function logRow(entry) {
+  var result = entry.result === "blocked" || entry.result === "failed"
+    ? "<span class=\"bad\">" + escape(entry.result) + "</span>" : escape(entry.result);
+  return [new Date(entry.time).toLocaleString(), entry.client, entry.name, entry.type,
+    entry.answer || entry.cname || entry.rcode, { html: result }, { text: entry.latency + " µs", num: true }];
+}
+
+function showLog() {
+  table("queryLog", ["Time", "Client", "Name", "Type", "Answer", "Result", "Latency"], logRows);
+  $("more").hidden = !logNext || stream !== null;
+}
+
+function searchLog(more) {
+  var url = "/querylog?limit=" + LogPage + "&" + logQuery + (more ? "&cursor=" + encodeURIComponent(logNext) : "");
+  return get(url).then(function (page) {
+    if (page.error) { throw new Error(page.error); }
+    var rows = page.entries.map(logRow);
+    logRows = more ? logRows.concat(rows) : rows;
+    logNext = page.next;
+    showLog();
+  });
+}
+
+// streamEvent handles one server-sent event
+function streamEvent(block) {
+  var name = "message", data = "";
+  block.split("\n").forEach(function (line) {
+    if (line.indexOf("event:") === 0) { name = line.slice(6).trim(); }
+    if (line.indexOf("data:") === 0) { data += line.slice(5).trim(); }
+  });
+  if (name === "query") {
+    logRows.unshift(logRow(JSON.parse(data)));
+    logRows = logRows.slice(0, LogPage);
+    showLog();
+  } else if (name === "dropped") {
+    showError(JSON.parse(data).dropped + " queries were too fast to show");
+  }
+}
+
+// watchLog reads the live stream with fetch rather than EventSource, which cannot send the sign in
+function watchLog() {
+  if (stream) { stream.abort(); stream = null; }
+  if (!$("live").checked) { return searchLog(false).catch(showError); }
+  logRows = [];
+  stream = new AbortController();
+  fetch("/querylog/stream?" + logQuery, { headers: headers(), signal: stream.signal }).then(function (response) {
+    if (!response.ok) { throw new Error("Could not watch the query log: " + response.statusText); }
+    var reader = response.body.getReader(), decoder = new TextDecoder(), buffer = "";
+    function read() {
+      return reader.read().then(function (chunk) {
+        if (chunk.done) { return; }
+        buffer += decoder.decode(chunk.value, { stream: true });
+        var events = buffer.split("\n\n");
+        buffer = events.pop();
+        events.forEach(streamEvent);
+        return read();
+      });
+    }
+    return read();
+  }).catch(function (err) {
+    if (err.name !== "AbortError") { showError(err); }
+  });
+  showLog();
+}
+
+$("logSearch").addEventListener("submit", function (event) {
+  event.preventDefault();
+  var params = new URLSearchParams(new FormData(event.target));
+  Array.from(params.keys()).forEach(function (key) { if (!params.get(key)) { params.delete(key); } });
+  logQuery = params.toString();
+  watchLog();
+});
+$("live").addEventListener("change", watchLog);
+$("more").addEventListener("click", function () { searchLog(true).catch(showError); });
+
+// Hosts and blocks are saved to the config file by the server
+function removeButton(kind, name) {
+  return { html: "<button data-kind=\"" + kind + "\" data-name=\"" + escape(name) + "\">Remove</button>" };
+}
+
+function loadConfig() {
+  return get("/admin/hosts").then(function (hosts) {
+    return get("/admin/blocks").then(function (blocks) { return [hosts, blocks]; });
+  }).then(function (results) {
+    var hosts = results[0] || {}, blocks = results[1] || {};
+    table("hosts", ["Name", "Target", ""], Object.keys(hosts).sort().map(function (name) {
+      return [name, hosts[name], removeButton("hosts", name)];
+    }));
+    table("blocks", ["Name", ""], Object.keys(blocks).sort().filter(function (name) {
+      return blocks[name];
+    }).map(function (name) { return [name, removeButton("blocks", name)]; }));
+  });
+}
+
+// edit resolves to whether the change was saved
+function edit(promise) {
+  return promise.then(function () {
+    showError(null);
+    loadConfig().catch(showError);
+    return true;
+  }).catch(function (err) {
+    showError(err);
+    return false;
+  });
+}
+
+// field avoids form.name and form.target, which are properties of the form itself
+function field(form, name) { return form.elements.namedItem(name).value; }
+
+document.addEventListener("click", function (event) {
+  var kind = event.target.getAttribute("data-kind");
+  if (kind && confirm("Remove " + event.target.getAttribute("data-name") + "?")) {
+    edit(request("DELETE", "/admin/" + kind + "/" + encodeURIComponent(event.target.getAttribute("data-name"))));
+  }
+});
+$("hostForm").addEventListener("submit", function (event) {
+  event.preventDefault();
+  var form = event.target;
+  edit(request("PUT", "/admin/hosts/" + encodeURIComponent(field(form, "name")), { target: field(form, "target") }))
+    .then(function (saved) { if (saved) { form.reset(); } });
+});
+$("blockForm").addEventListener("submit", function (event) {
+  event.preventDefault();
+  var form = event.target;
+  edit(request("PUT", "/admin/blocks/" + encodeURIComponent(field(form, "name"))))
+    .then(function (saved) { if (saved) { form.reset(); } });
+});
+
+function refresh() {
+  Promise.all([loadStatus(), loadHistory(), loadTop()]).then(function () { showError(null); }).catch(showError);
+}
+
+refresh();
+loadConfig().catch(function (err) {
+  if (err.status !== 403) { return showError(err); }
+  // The admin API is off until auth is configured, or this user is not an admin
+  ["hostForm", "blockForm"].forEach(function (id) { $(id).hidden = true; });
+  ["hosts", "blocks"].forEach(function (id) { $(id).innerHTML = "<tr><td>" + escape(err.message) + "</td></tr>"; });
+});
+searchLog(false).catch(function () { $("queryLog").innerHTML = "<tr><td>The query log is disabled</td></tr>"; });
+setInterval(refresh, RefreshEvery);
+`
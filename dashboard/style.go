@@ -0,0 +1,37 @@
+package dashboard
+
+const style = `
+:root { --bg: #f4f5f7; --panel: #fff; --text: #222; --muted: #777; --line: #e3e5e8;
+  --queries: #3b7dd8; --cached: #2e9e5b; --blocked: #d64545; }
+@media (prefers-color-scheme: dark) {
+  :root { --bg: #16181c; --panel: #1f2228; --text: #e6e6e6; --muted: #999; --line: #33373f; }
+}
+* { box-sizing: border-box; }
+body { margin: 0; font: 14px/1.4 system-ui, sans-serif; background: var(--bg); color: var(--text); }
+header { display: flex; gap: 1em; align-items: baseline; padding: .8em 1.5em; background: var(--panel);
+  border-bottom: 1px solid var(--line); }
+header h1 { margin: 0; font-size: 1.3em; }
+main { display: grid; grid-template-columns: repeat(auto-fill, minmax(360px, 1fr)); gap: 1em; padding: 1em 1.5em; }
+.cards { grid-column: 1 / -1; display: grid; grid-template-columns: repeat(auto-fit, minmax(140px, 1fr)); gap: 1em; }
+.card, .panel { background: var(--panel); border: 1px solid var(--line); border-radius: 6px; padding: .8em 1em; }
+.card label { display: block; color: var(--muted); font-size: .85em; }
+.card b { font-size: 1.6em; }
+.wide { grid-column: 1 / -1; }
+h2 { margin: 0 0 .6em; font-size: 1em; }
+h2 small { color: var(--muted); font-weight: normal; }
+table { width: 100%; border-collapse: collapse; }
+td, th { padding: .25em .4em; border-bottom: 1px solid var(--line); text-align: left; word-break: break-all; }
+th { color: var(--muted); font-weight: normal; font-size: .85em; }
+td.num { text-align: right; white-space: nowrap; }
+canvas { width: 100%; }
+.legend span { margin-right: 1em; }
+.legend span::before { content: ""; display: inline-block; width: .8em; height: .8em; margin-right: .3em; }
+.legend .queries::before { background: var(--queries); }
+.legend .cachedKey::before { background: var(--cached); }
+.legend .blockedKey::before { background: var(--blocked); }
+.row { display: flex; flex-wrap: wrap; gap: .5em; margin-bottom: .6em; }
+.row input:not([type=checkbox]) { flex: 1; min-width: 8em; }
+input, select, button { font: inherit; padding: .3em .5em; }
+.good { color: var(--cached); }
+.bad { color: var(--blocked); }
+`
@@ -27,6 +27,8 @@ type DnsResolver struct {
 	log        *logrus.Logger
 	DohServer  *string
 	httpClient *http.Client
+	// Observer is told how long each query to an upstream server took, if set
+	Observer func(server string, took time.Duration, err error)
 }
 
 type DnsResult struct {
@@ -34,6 +36,36 @@ type DnsResult struct {
 	Server string
 }
 
+// RcodeError is returned when an upstream answered, but with a failure code
+type RcodeError struct {
+	Rcode int
+}
+
+func (this *RcodeError) Error() string {
+	return dns.RcodeToString[this.Rcode]
+}
+
+// NoAddressesError is returned when an upstream answered, but without any addresses for the name
+type NoAddressesError struct {
+	Name string
+}
+
+func (this *NoAddressesError) Error() string {
+	return "no addresses for " + this.Name
+}
+
+// IsUnreachable reports whether err means the upstreams could not give an answer,
+// as opposed to an answer saying the name does not exist or has no addresses
+func IsUnreachable(err error) bool {
+	if _, ok := err.(*NoAddressesError); ok {
+		return false
+	}
+	if rcodeError, ok := err.(*RcodeError); ok {
+		return rcodeError.Rcode == dns.RcodeServerFailure || rcodeError.Rcode == dns.RcodeRefused
+	}
+	return err != nil
+}
+
 type Ip struct {
 	Address string
 	Ttl     uint32
@@ -42,12 +74,13 @@ type Ip struct {
 
 // New initializes DnsResolver.
 func New(servers []string, dohServer *string) *DnsResolver {
+	addresses := make([]string, len(servers))
 	for i := range servers {
-		servers[i] = net.JoinHostPort(servers[i], "53")
+		addresses[i] = net.JoinHostPort(servers[i], "53")
 	}
 
 	return &DnsResolver{
-		Servers:    servers,
+		Servers:    addresses,
 		RetryTimes: len(servers) * 2,
 		log:        logging.GetLogger(),
 		DohServer:  dohServer,
@@ -98,7 +131,9 @@ func (r *DnsResolver) lookupHostDoh(host string) *DnsResult {
 		return nil
 	}
 	req.Header.Add("accept", "application/dns-json")
+	start := time.Now()
 	resp, err := r.httpClient.Do(req)
+	r.observe(fmt.Sprintf("https://%s", *r.DohServer), start, err)
 	if err != nil {
 		r.log.Warn("Error Sending Request", err)
 		return nil
@@ -147,7 +182,9 @@ func (r *DnsResolver) lookupHost(host string, triesLeft int) (*DnsResult, error)
 		Qclass: dns.ClassINET,
 	}
 	server := r.Servers[(r.RetryTimes-triesLeft)%len(r.Servers)]
+	start := time.Now()
 	in, err := dns.Exchange(m1, server)
+	r.observe(server, start, err)
 
 	result := &DnsResult{
 		Ips:    make([]Ip, 0),
@@ -163,7 +200,7 @@ func (r *DnsResolver) lookupHost(host string, triesLeft int) (*DnsResult, error)
 	}
 
 	if in != nil && in.Rcode != dns.RcodeSuccess {
-		return result, errors.New(dns.RcodeToString[in.Rcode])
+		return result, &RcodeError{Rcode: in.Rcode}
 	}
 
 	for _, record := range in.Answer {
@@ -178,6 +215,12 @@ func (r *DnsResolver) lookupHost(host string, triesLeft int) (*DnsResult, error)
 	return result, err
 }
 
+func (r *DnsResolver) observe(server string, start time.Time, err error) {
+	if r.Observer != nil {
+		r.Observer(server, time.Since(start), err)
+	}
+}
+
 type DohResponse struct {
 	Status   int           `json:"Status"`
 	TC       bool          `json:"TC"`
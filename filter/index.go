@@ -0,0 +1,177 @@
+// Package filter implements AdGuard/ABP style DNS filtering rules,
+// so community filter lists can be used as they are published
+package filter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+)
+
+// List is a set of rules indexed for fast lookup.
+// A List is not safe to modify while it is being matched against,
+// build a new one and swap it in instead
+type List struct {
+	domains  map[string][]*Rule
+	exact    map[string][]*Rule
+	patterns []*Rule
+	// disabled holds the text of rules turned off by a $badfilter rule
+	disabled map[string]bool
+	size     int
+}
+
+func NewList() *List {
+	return &List{
+		domains:  make(map[string][]*Rule),
+		exact:    make(map[string][]*Rule),
+		patterns: make([]*Rule, 0),
+		disabled: make(map[string]bool),
+	}
+}
+
+// Add parses a line and adds the resulting rules to the list.
+// Blank lines, comments and rules that do not apply to DNS are skipped without error
+func (this *List) Add(line string) error {
+	return this.add(line, "")
+}
+
+func (this *List) add(line string, source string) error {
+	fields := strings.Fields(line)
+	if len(fields) > 2 && net.ParseIP(fields[0]) != nil {
+		// Hosts file line with several names
+		for _, host := range fields[1:] {
+			if strings.HasPrefix(host, "#") {
+				break
+			}
+			if err := this.add(fields[0]+" "+host, source); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	rule, err := Parse(line)
+	if err == ErrEmptyRule || err == ErrIgnored {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rule.Source = source
+	this.AddRule(rule)
+	return nil
+}
+
+// AddAll reads a whole filter list, returning the number of rules added and the lines that failed
+func (this *List) AddAll(reader io.Reader) (int, []error) {
+	return this.AddSource(reader, "")
+}
+
+// AddSource is AddAll for a named filter list, which is kept as the Source of its rules
+func (this *List) AddSource(reader io.Reader, source string) (int, []error) {
+	errs := make([]error, 0)
+	before := this.size
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := this.add(scanner.Text(), source); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return this.size - before, errs
+}
+
+func (this *List) AddRule(rule *Rule) {
+	if rule.Disables != "" {
+		this.disabled[rule.Disables] = true
+		return
+	}
+	this.size++
+	switch {
+	case rule.pattern != nil:
+		this.patterns = append(this.patterns, rule)
+	case rule.exact:
+		this.exact[rule.domain] = append(this.exact[rule.domain], rule)
+	default:
+		this.domains[rule.domain] = append(this.domains[rule.domain], rule)
+	}
+}
+
+// Len returns the number of rules in the list
+func (this *List) Len() int {
+	if this == nil {
+		return 0
+	}
+	return this.size
+}
+
+// Match finds the rule that decides the query, or nil if no rule applies.
+// A returned rule with Exception set means the host is explicitly allowed.
+// Precedence is: important exception, important block, exception, block
+func (this *List) Match(host string, qtype uint16, client *Client) *Rule {
+	var best *Rule
+	this.each(host, qtype, client, func(rule *Rule) {
+		if rank(rule) > rank(best) {
+			best = rule
+		}
+	})
+	return best
+}
+
+// MatchAll finds every rule that applies to the query, in no particular order.
+// Match picks the one of them that decides it
+func (this *List) MatchAll(host string, qtype uint16, client *Client) []*Rule {
+	rules := make([]*Rule, 0)
+	this.each(host, qtype, client, func(rule *Rule) {
+		rules = append(rules, rule)
+	})
+	return rules
+}
+
+// each calls consider with every rule that applies to the query
+func (this *List) each(host string, qtype uint16, client *Client, consider func(*Rule)) {
+	if this == nil {
+		return
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	visit := func(rule *Rule) {
+		if !this.disabled[rule.Text] && rule.appliesTo(host, qtype, client) {
+			consider(rule)
+		}
+	}
+	for _, rule := range this.exact[host] {
+		visit(rule)
+	}
+	for suffix := host; suffix != ""; {
+		for _, rule := range this.domains[suffix] {
+			visit(rule)
+		}
+		i := strings.Index(suffix, ".")
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	for _, rule := range this.patterns {
+		if rule.matchesHost(host) {
+			visit(rule)
+		}
+	}
+}
+
+func rank(rule *Rule) int {
+	switch {
+	case rule == nil:
+		return 0
+	case rule.Important && rule.Exception:
+		return 4
+	case rule.Important:
+		return 3
+	case rule.Exception:
+		return 2
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,72 @@
+package filter
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMatchPrecedence(t *testing.T) {
+	list := NewList()
+	added, errs := list.AddAll(strings.NewReader(strings.Join([]string{
+		"! Title: test",
+		"127.0.0.1 localhost localhost.localdomain",
+		"0.0.0.0 ads.example tracker.example",
+		"||ads.example^",
+		"@@||ok.ads.example^",
+		"||ok.ads.example^$important",
+		"||forced.example^$important",
+		"@@||forced.example^",
+		"@@||vip.forced.example^$important",
+		"||kids.example^$client=10.1.0.0/16",
+		"||old.example^",
+		"||old.example^$badfilter",
+	}, "\n")))
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if added != 10 || list.Len() != 10 {
+		t.Errorf("expected 10 rules, added %d and Len is %d", added, list.Len())
+	}
+	kid := &Client{Ip: net.ParseIP("10.1.2.3")}
+	tests := []struct {
+		host   string
+		client *Client
+		rule   string
+	}{
+		{"localhost.", nil, ""},
+		{"tracker.example.", nil, "0.0.0.0 tracker.example"},
+		{"sub.ads.example.", nil, "||ads.example^"},
+		// An exception beats a plain block
+		{"x.ok.ads.example.", nil, "||ok.ads.example^$important"},
+		// An important block beats an exception
+		{"forced.example.", nil, "||forced.example^$important"},
+		// An important exception beats everything
+		{"vip.forced.example.", nil, "@@||vip.forced.example^$important"},
+		{"kids.example.", kid, "||kids.example^$client=10.1.0.0/16"},
+		{"kids.example.", nil, ""},
+		{"old.example.", nil, ""},
+		{"other.example.", nil, ""},
+	}
+	for _, test := range tests {
+		rule := list.Match(test.host, dns.TypeA, test.client)
+		text := ""
+		if rule != nil {
+			text = rule.Text
+		}
+		if text != test.rule {
+			t.Errorf("%s: expected %q, got %q", test.host, test.rule, text)
+		}
+	}
+
+	list = NewList()
+	_ = list.Add("||ads.example^")
+	_ = list.Add("@@||ads.example^")
+	if rule := list.Match("ads.example", dns.TypeA, nil); rule == nil || !rule.Exception {
+		t.Errorf("expected the exception to win over a plain block, got %v", rule)
+	}
+	if rules := list.MatchAll("ads.example", dns.TypeA, nil); len(rules) != 2 {
+		t.Errorf("expected both rules to apply, got %d", len(rules))
+	}
+}
@@ -0,0 +1,438 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Rule is a single parsed filtering rule
+type Rule struct {
+	// Text is the rule exactly as it appeared in the list
+	Text      string
+	Exception bool
+	Important bool
+	// Disables is the text of the rule a $badfilter rule turns off
+	Disables string
+	// Source is the filter list the rule was read from, empty for rules added on their own
+	Source string
+
+	clients   []clientMatcher
+	dnsTypes  []uint16
+	notTypes  []uint16
+	denyAllow []string
+
+	// domain is set for rules that can be matched by a map lookup instead of a regex
+	domain string
+	// exact is true when domain must match the host exactly (hosts file style)
+	exact   bool
+	pattern *regexp.Regexp
+}
+
+// Client describes who sent a query, used by $client rules
+type Client struct {
+	Ip   net.IP
+	Name string
+}
+
+type clientMatcher struct {
+	negate bool
+	ip     net.IP
+	subnet *net.IPNet
+	name   string
+}
+
+var (
+	hostRegex     = regexp.MustCompile("^[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?(\\.[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?)*$")
+	ErrIgnored    = errors.New("rule is not applicable to DNS filtering")
+	ErrEmptyRule  = errors.New("empty rule")
+	cosmeticMarks = []string{"##", "#@#", "#?#", "#$#", "#%#"}
+	// Names that hosts based lists point at loopback for reasons other than blocking
+	localHosts = map[string]bool{
+		"localhost":             true,
+		"localhost.localdomain": true,
+		"local":                 true,
+		"broadcasthost":         true,
+		"ip6-localhost":         true,
+		"ip6-loopback":          true,
+		"0.0.0.0":               true,
+	}
+	// Modifiers only browsers can apply, a rule using one of them is skipped instead of failing
+	ignoredModifiers = map[string]bool{
+		"third-party":    true,
+		"3p":             true,
+		"first-party":    true,
+		"1p":             true,
+		"domain":         true,
+		"document":       true,
+		"doc":            true,
+		"script":         true,
+		"image":          true,
+		"stylesheet":     true,
+		"css":            true,
+		"subdocument":    true,
+		"frame":          true,
+		"xmlhttprequest": true,
+		"xhr":            true,
+		"media":          true,
+		"font":           true,
+		"object":         true,
+		"ping":           true,
+		"websocket":      true,
+		"popup":          true,
+		"other":          true,
+		"match-case":     true,
+		"redirect":       true,
+		"removeparam":    true,
+		"csp":            true,
+		"all":            true,
+	}
+)
+
+// Parse parses a single line of an AdGuard/ABP style filter list, or a hosts file line.
+// Comments, blank lines and cosmetic rules return ErrEmptyRule or ErrIgnored
+func Parse(line string) (*Rule, error) {
+	text := strings.TrimSpace(line)
+	if text == "" || strings.HasPrefix(text, "!") || strings.HasPrefix(text, "[") {
+		return nil, ErrEmptyRule
+	}
+	for _, mark := range cosmeticMarks {
+		if strings.Contains(text, mark) {
+			return nil, ErrIgnored
+		}
+	}
+	if strings.HasPrefix(text, "#") {
+		return nil, ErrEmptyRule
+	}
+	if rule, ok := parseHostsLine(text); ok {
+		if rule == nil {
+			return nil, ErrIgnored
+		}
+		return rule, nil
+	}
+
+	rule := &Rule{Text: text}
+	body := text
+	if strings.HasPrefix(body, "@@") {
+		rule.Exception = true
+		body = body[2:]
+	}
+
+	pattern, modifiers := splitModifiers(body)
+	if err := rule.parseModifiers(modifiers); err == ErrIgnored {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %s", text, err.Error())
+	}
+	if err := rule.parsePattern(pattern); err != nil {
+		return nil, fmt.Errorf("%s: %s", text, err.Error())
+	}
+	if rule.Disables != "" {
+		rule.Disables = strings.TrimSuffix(text[:len(text)-len(modifiers)], "$")
+		if others := withoutBadFilter(modifiers); others != "" {
+			rule.Disables += "$" + others
+		}
+	}
+	return rule, nil
+}
+
+// withoutBadFilter drops $badfilter from a modifier list, leaving the modifiers of the rule it disables
+func withoutBadFilter(modifiers string) string {
+	others := make([]string, 0)
+	for _, modifier := range splitOutsideQuotes(modifiers, ',') {
+		if !strings.EqualFold(strings.TrimSpace(modifier), "badfilter") {
+			others = append(others, modifier)
+		}
+	}
+	return strings.Join(others, ",")
+}
+
+// parseHostsLine handles "0.0.0.0 example.com" and bare "example.com" lines.
+// Both match the host exactly, the way a hosts file would.
+// A hosts line that blocks nothing, like "127.0.0.1 localhost", returns a nil rule
+func parseHostsLine(text string) (*Rule, bool) {
+	if i := strings.Index(text, "#"); i > 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 1 {
+		if net.ParseIP(fields[0]) != nil {
+			return nil, true
+		}
+		host := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if hostRegex.MatchString(host) && strings.Contains(host, ".") {
+			return &Rule{Text: text, domain: host, exact: true}, true
+		}
+		return nil, false
+	}
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, false
+	}
+	// Only the first host name is used here, List.Add splits lines with several
+	host := strings.ToLower(strings.TrimSuffix(fields[1], "."))
+	if localHosts[host] || net.ParseIP(host) != nil || !hostRegex.MatchString(host) {
+		return nil, true
+	}
+	return &Rule{Text: text, domain: host, exact: true}, true
+}
+
+// splitModifiers splits "pattern$mod1,mod2" into its pattern and modifier list
+func splitModifiers(body string) (string, string) {
+	if strings.HasPrefix(body, "/") {
+		// Regex rules may contain '$' themselves, so only look after the closing slash
+		end := strings.LastIndex(body, "/")
+		if end > 0 {
+			rest := body[end+1:]
+			if strings.HasPrefix(rest, "$") {
+				return body[:end+1], rest[1:]
+			}
+			if rest == "" {
+				return body, ""
+			}
+		}
+	}
+	i := strings.LastIndex(body, "$")
+	if i < 0 {
+		return body, ""
+	}
+	return body[:i], body[i+1:]
+}
+
+func (this *Rule) parseModifiers(modifiers string) error {
+	if modifiers == "" {
+		return nil
+	}
+	for _, modifier := range splitOutsideQuotes(modifiers, ',') {
+		name, value := modifier, ""
+		if i := strings.Index(modifier, "="); i >= 0 {
+			name, value = modifier[:i], modifier[i+1:]
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "important":
+			this.Important = true
+		case "badfilter":
+			this.Disables = "-"
+		case "client":
+			for _, item := range splitOutsideQuotes(value, '|') {
+				matcher, err := parseClient(item)
+				if err != nil {
+					return err
+				}
+				this.clients = append(this.clients, matcher)
+			}
+		case "dnstype":
+			for _, item := range strings.Split(value, "|") {
+				negate := strings.HasPrefix(item, "~")
+				qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimPrefix(item, "~"))]
+				if !ok {
+					return fmt.Errorf("unknown dnstype %q", item)
+				}
+				if negate {
+					this.notTypes = append(this.notTypes, qtype)
+				} else {
+					this.dnsTypes = append(this.dnsTypes, qtype)
+				}
+			}
+		case "denyallow":
+			for _, item := range strings.Split(value, "|") {
+				host := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(item), "."))
+				if !hostRegex.MatchString(host) {
+					return fmt.Errorf("invalid denyallow domain %q", item)
+				}
+				this.denyAllow = append(this.denyAllow, host)
+			}
+		default:
+			if ignoredModifiers[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "~"))] {
+				return ErrIgnored
+			}
+			return fmt.Errorf("unsupported modifier %q", name)
+		}
+	}
+	return nil
+}
+
+func parseClient(item string) (clientMatcher, error) {
+	item = strings.TrimSpace(item)
+	matcher := clientMatcher{}
+	if strings.HasPrefix(item, "~") {
+		matcher.negate = true
+		item = item[1:]
+	}
+	if len(item) >= 2 && (item[0] == '\'' || item[0] == '"') && item[len(item)-1] == item[0] {
+		matcher.name = strings.ReplaceAll(item[1:len(item)-1], "\\", "")
+		return matcher, nil
+	}
+	if ip := net.ParseIP(item); ip != nil {
+		matcher.ip = ip
+		return matcher, nil
+	}
+	if _, subnet, err := net.ParseCIDR(item); err == nil {
+		matcher.subnet = subnet
+		return matcher, nil
+	}
+	if item == "" {
+		return matcher, errors.New("empty client")
+	}
+	matcher.name = item
+	return matcher, nil
+}
+
+func (this *Rule) parsePattern(pattern string) error {
+	if pattern == "" {
+		return ErrEmptyRule
+	}
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		regex, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return err
+		}
+		this.pattern = regex
+		return nil
+	}
+	pattern = strings.ToLower(pattern)
+
+	// The common "||example.com^" form is matched by domain lookup
+	if strings.HasPrefix(pattern, "||") {
+		host := strings.TrimSuffix(strings.TrimSuffix(pattern[2:], "|"), "^")
+		if host != pattern[2:] && hostRegex.MatchString(host) {
+			this.domain = host
+			return nil
+		}
+	}
+
+	builder := strings.Builder{}
+	rest := pattern
+	switch {
+	case strings.HasPrefix(rest, "||"):
+		builder.WriteString("^([^.]+\\.)*")
+		rest = rest[2:]
+	case strings.HasPrefix(rest, "|"):
+		builder.WriteString("^")
+		rest = rest[1:]
+	}
+	anchorEnd := false
+	if strings.HasSuffix(rest, "|") {
+		anchorEnd = true
+		rest = rest[:len(rest)-1]
+	}
+	for _, char := range rest {
+		switch char {
+		case '*':
+			builder.WriteString(".*")
+		case '^':
+			builder.WriteString("([^a-z0-9_.%-]|$)")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	if anchorEnd {
+		builder.WriteString("$")
+	}
+	regex, err := regexp.Compile(builder.String())
+	if err != nil {
+		return err
+	}
+	this.pattern = regex
+	return nil
+}
+
+// matchesHost checks only the pattern part of the rule, not its modifiers
+func (this *Rule) matchesHost(host string) bool {
+	if this.pattern != nil {
+		return this.pattern.MatchString(host)
+	}
+	if this.exact {
+		return host == this.domain
+	}
+	return isSubdomain(host, this.domain)
+}
+
+// appliesTo checks the rule modifiers against the query
+func (this *Rule) appliesTo(host string, qtype uint16, client *Client) bool {
+	for _, t := range this.notTypes {
+		if t == qtype {
+			return false
+		}
+	}
+	if len(this.dnsTypes) > 0 && !containsType(this.dnsTypes, qtype) {
+		return false
+	}
+	for _, domain := range this.denyAllow {
+		if isSubdomain(host, domain) {
+			return false
+		}
+	}
+	if len(this.clients) > 0 && !this.matchesClient(client) {
+		return false
+	}
+	return true
+}
+
+func (this *Rule) matchesClient(client *Client) bool {
+	allowed := false
+	hasPositive := false
+	for _, matcher := range this.clients {
+		matches := client != nil && matcher.matches(client)
+		if matcher.negate {
+			if matches {
+				return false
+			}
+			continue
+		}
+		hasPositive = true
+		allowed = allowed || matches
+	}
+	return allowed || !hasPositive
+}
+
+func (this clientMatcher) matches(client *Client) bool {
+	switch {
+	case this.ip != nil:
+		return client.Ip != nil && this.ip.Equal(client.Ip)
+	case this.subnet != nil:
+		return client.Ip != nil && this.subnet.Contains(client.Ip)
+	default:
+		return client.Name != "" && strings.EqualFold(this.name, client.Name)
+	}
+}
+
+func containsType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func isSubdomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func splitOutsideQuotes(value string, sep rune) []string {
+	parts := make([]string, 0)
+	current := strings.Builder{}
+	var quote rune
+	escaped := false
+	for _, char := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\':
+			escaped = true
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote == 0 && (char == '\'' || char == '"'):
+			quote = char
+		case quote == 0 && char == sep:
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(char)
+	}
+	return append(parts, current.String())
+}
@@ -0,0 +1,107 @@
+package filter
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line      string
+		err       error
+		exception bool
+		important bool
+		matches   []string
+		misses    []string
+	}{
+		{line: "", err: ErrEmptyRule},
+		{line: "! comment", err: ErrEmptyRule},
+		{line: "# comment", err: ErrEmptyRule},
+		{line: "[Adblock Plus 2.0]", err: ErrEmptyRule},
+		{line: "example.com##.ad", err: ErrIgnored},
+		{line: "127.0.0.1 localhost", err: ErrIgnored},
+		{line: "::1 localhost", err: ErrIgnored},
+		{line: "0.0.0.0 0.0.0.0", err: ErrIgnored},
+		{line: "127.0.0.1", err: ErrIgnored},
+		{line: "||ads.example^$third-party", err: ErrIgnored},
+		{line: "0.0.0.0 ads.example # tracker", matches: []string{"ads.example"}, misses: []string{"sub.ads.example"}},
+		{line: "ads.example", matches: []string{"ads.example"}, misses: []string{"sub.ads.example"}},
+		{line: "||ads.example^", matches: []string{"ads.example", "sub.ads.example"}, misses: []string{"bads.example"}},
+		{line: "@@||ads.example^", exception: true, matches: []string{"ads.example"}},
+		{line: "||ads.example^$important", important: true, matches: []string{"ads.example"}},
+		{line: "/^ad[0-9]+\\./", matches: []string{"ad12.example"}, misses: []string{"bad1.example"}},
+		{line: "|ads.", matches: []string{"ads.example"}, misses: []string{"x.ads.example"}},
+		{line: "*tracker*", matches: []string{"my-tracker.example"}, misses: []string{"example"}},
+	}
+	for _, test := range tests {
+		rule, err := Parse(test.line)
+		if err != test.err {
+			t.Errorf("%q: expected error %v, got %v", test.line, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if rule.Exception != test.exception || rule.Important != test.important {
+			t.Errorf("%q: expected exception %v and important %v, got %v and %v",
+				test.line, test.exception, test.important, rule.Exception, rule.Important)
+		}
+		for _, host := range test.matches {
+			if !rule.matchesHost(host) {
+				t.Errorf("%q should match %s", test.line, host)
+			}
+		}
+		for _, host := range test.misses {
+			if rule.matchesHost(host) {
+				t.Errorf("%q should not match %s", test.line, host)
+			}
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, line := range []string{"||ads.example^$dnstype=NOPE", "||ads.example^$nosuchmodifier", "/[/"} {
+		if _, err := Parse(line); err == nil || err == ErrIgnored || err == ErrEmptyRule {
+			t.Errorf("%q: expected a parse error, got %v", line, err)
+		}
+	}
+}
+
+func TestModifiers(t *testing.T) {
+	local := &Client{Ip: net.ParseIP("192.168.1.5"), Name: "laptop"}
+	other := &Client{Ip: net.ParseIP("10.0.0.5"), Name: "phone"}
+	tests := []struct {
+		line    string
+		qtype   uint16
+		client  *Client
+		applies bool
+	}{
+		{"||ads.example^$dnstype=AAAA", dns.TypeAAAA, local, true},
+		{"||ads.example^$dnstype=AAAA", dns.TypeA, local, false},
+		{"||ads.example^$dnstype=~A", dns.TypeA, local, false},
+		{"||ads.example^$dnstype=~A", dns.TypeMX, local, true},
+		{"||ads.example^$client=192.168.1.0/24", dns.TypeA, local, true},
+		{"||ads.example^$client=192.168.1.0/24", dns.TypeA, other, false},
+		{"||ads.example^$client='laptop'", dns.TypeA, local, true},
+		{"||ads.example^$client=~10.0.0.5", dns.TypeA, other, false},
+		{"||ads.example^$client=~10.0.0.5", dns.TypeA, local, true},
+		{"||ads.example^$client=laptop", dns.TypeA, nil, false},
+	}
+	for _, test := range tests {
+		rule, err := Parse(test.line)
+		if err != nil {
+			t.Fatalf("%q: %s", test.line, err.Error())
+		}
+		if applies := rule.appliesTo("ads.example", test.qtype, test.client); applies != test.applies {
+			t.Errorf("%q for %s from %v: expected %v", test.line, dns.TypeToString[test.qtype], test.client, test.applies)
+		}
+	}
+	rule, err := Parse("||example^$denyallow=good.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.appliesTo("good.example", dns.TypeA, nil) || !rule.appliesTo("bad.example", dns.TypeA, nil) {
+		t.Errorf("denyallow should exempt only good.example")
+	}
+}
@@ -3,17 +3,17 @@ module gitlab.com/kamackay/dns
 go 1.14
 
 require (
-	github.com/avct/uasurfer v0.0.0-20191028135549-26b5daa857f1 // indirect
+	github.com/avct/uasurfer v0.0.0-20191028135549-26b5daa857f1
 	github.com/dustin/go-humanize v1.0.0
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-contrib/gzip v0.0.2
 	github.com/gin-gonic/gin v1.6.3
-	github.com/jinzhu/copier v0.0.0-20190924061706-b57f9002281a // indirect
 	github.com/json-iterator/go v1.1.10
 	github.com/miekg/dns v1.1.30
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/rs/zerolog v1.19.0
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 )
@@ -7,6 +7,9 @@ import (
 	"os"
 )
 
+// level is what every logger is made with, set from the command line
+var level = logrus.InfoLevel
+
 func init() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
@@ -25,6 +28,19 @@ func GetLogger() *logrus.Logger {
 		FullTimestamp: true,
 		ForceColors:   true,
 	})
-	logger.SetLevel(logrus.InfoLevel)
+	logger.SetLevel(level)
 	return logger
 }
+
+// SetLevel changes the level of every logger made after it, like debug, info, warn or error
+func SetLevel(name string) error {
+	parsed, err := logrus.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level = parsed
+	if zerologLevel, err := zerolog.ParseLevel(name); err == nil {
+		zerolog.SetGlobalLevel(zerologLevel)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Package oidc checks ID and access tokens signed by an OpenID Connect issuer.
+// The signing keys are found through the issuer's discovery document, and fetched again
+// when a token is signed by a key that is not known yet, so the issuer can rotate them
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Leeway allows for clocks that are slightly out of step with the issuer
+	Leeway = time.Minute
+	// RefreshEvery limits how often unknown key IDs can make the keys be fetched again
+	RefreshEvery = time.Minute
+)
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrSignature  = errors.New("invalid token signature")
+	ErrExpired    = errors.New("token has expired")
+	ErrIssuer     = errors.New("token is from another issuer")
+	ErrAudience   = errors.New("token is for another audience")
+	ErrUnknownKey = errors.New("token is signed with an unknown key")
+)
+
+// curveBits is the curve each ECDSA algorithm is defined with
+var curveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// Claims are the verified contents of a token
+type Claims map[string]interface{}
+
+type Verifier struct {
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// New verifies tokens from the issuer, which must be for the audience unless it is empty
+func New(issuer string, audience string) *Verifier {
+	return &Verifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		keys:     make(map[string]crypto.PublicKey),
+	}
+}
+
+// Verify checks the signature, issuer, audience and lifetime of a token, and returns its claims
+func (this *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	key, err := this.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	claims := make(Claims)
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if claims.String("iss") != this.issuer {
+		return nil, ErrIssuer
+	}
+	if this.audience != "" && !claims.Has("aud", this.audience) {
+		return nil, ErrAudience
+	}
+	now := time.Now()
+	if expires, ok := claims.time("exp"); !ok || now.After(expires.Add(Leeway)) {
+		return nil, ErrExpired
+	}
+	if notBefore, ok := claims.time("nbf"); ok && now.Add(Leeway).Before(notBefore) {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// String is a claim as a string, empty if it is missing or something else
+func (this Claims) String(name string) string {
+	value, _ := this[name].(string)
+	return value
+}
+
+// Has reports whether a claim is the value, or a list holding it
+func (this Claims) Has(name string, value string) bool {
+	switch claim := this[name].(type) {
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, item := range claim {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (this Claims) time(name string) (time.Time, bool) {
+	seconds, ok := this[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func verifySignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(algorithm) != 5 {
+		return fmt.Errorf("unsupported token algorithm %q", algorithm)
+	}
+	var hash crypto.Hash
+	switch algorithm[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 || !hash.Available() {
+		// Also rules out "none" and the HMAC algorithms, which have no public key
+		return fmt.Errorf("unsupported token algorithm %q", algorithm)
+	}
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+	switch public := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if strings.HasPrefix(algorithm, "RS") {
+			err = rsa.VerifyPKCS1v15(public, hash, sum, signature)
+		} else if strings.HasPrefix(algorithm, "PS") {
+			err = rsa.VerifyPSS(public, hash, sum, signature, nil)
+		} else {
+			return fmt.Errorf("algorithm %s does not match an RSA key", algorithm)
+		}
+		if err != nil {
+			return ErrSignature
+		}
+	case *ecdsa.PublicKey:
+		bits := public.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if !strings.HasPrefix(algorithm, "ES") || curveBits[algorithm] != bits || len(signature) != 2*size {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(public, sum, r, s) {
+			return ErrSignature
+		}
+	default:
+		return ErrUnknownKey
+	}
+	return nil
+}
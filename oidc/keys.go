@@ -0,0 +1,158 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type discovery struct {
+	Issuer  string `json:"issuer"`
+	JwksUri string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key finds the signing key, fetching the keys again if it is not known.
+// The fetch runs without the lock, so tokens signed with known keys are not held up by it
+func (this *Verifier) key(id string) (crypto.PublicKey, error) {
+	this.mutex.Lock()
+	key, ok := this.lookup(id)
+	refresh := !ok && time.Since(this.fetched) >= RefreshEvery
+	if refresh {
+		// Claimed under the lock, so only one request fetches at a time
+		this.fetched = time.Now()
+	}
+	this.mutex.Unlock()
+	if ok {
+		return key, nil
+	} else if !refresh {
+		return nil, ErrUnknownKey
+	}
+	keys, err := this.fetchKeys()
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the keys of %s: %s", this.issuer, err.Error())
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.keys = keys
+	if key, ok := this.lookup(id); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup finds a key by ID, a token without one can only use the issuer's only key
+func (this *Verifier) lookup(id string) (crypto.PublicKey, bool) {
+	if id == "" && len(this.keys) == 1 {
+		for _, key := range this.keys {
+			return key, true
+		}
+	}
+	key, ok := this.keys[id]
+	return key, ok
+}
+
+func (this *Verifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var config discovery
+	if err := this.getJson(this.issuer+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != this.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", config.Issuer)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := this.getJson(config.JwksUri, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		// Keys of other types are skipped, they cannot have signed a token this accepts
+		if public, err := key.publicKey(); err == nil {
+			keys[key.Kid] = public
+		}
+	}
+	return keys, nil
+}
+
+func (this *Verifier) getJson(url string, target interface{}) error {
+	response, err := this.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+func (this *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch this.Kty {
+	case "RSA":
+		n, err := decodeInt(this.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(this.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch this.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", this.Crv)
+		}
+		x, err := decodeInt(this.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(this.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", this.Kty)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
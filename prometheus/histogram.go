@@ -0,0 +1,81 @@
+package prometheus
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are upper bounds in seconds, suited to DNS answers
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Histogram counts observations into buckets for each combination of label values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: sorted,
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+func (this *Histogram) Observe(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	histogram, ok := this.values[key]
+	if !ok {
+		histogram = &histogramValue{
+			labels: append([]string{}, values...),
+			counts: make([]uint64, len(this.buckets)),
+		}
+		this.values[key] = histogram
+	}
+	// Buckets are written cumulatively, so only the first one that fits is counted here
+	if i := sort.SearchFloat64s(this.buckets, value); i < len(this.buckets) {
+		histogram.counts[i]++
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+func (this *Histogram) Collect(writer *Writer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	writer.Header(this.name, this.help, histogramType)
+	for _, key := range sortedKeys(this.values) {
+		histogram := this.values[key]
+		labels := pairs(this.labels, histogram.labels)
+		var cumulative uint64
+		for i, bound := range this.buckets {
+			cumulative += histogram.counts[i]
+			writer.Sample(this.name+"_bucket", float64(cumulative), append(labels, "le", formatFloat(bound))...)
+		}
+		writer.Sample(this.name+"_bucket", float64(histogram.count), append(labels, "le", formatFloat(math.Inf(1)))...)
+		writer.Sample(this.name+"_sum", histogram.sum, labels...)
+		writer.Sample(this.name+"_count", float64(histogram.count), labels...)
+	}
+}
@@ -0,0 +1,203 @@
+// Package prometheus writes metrics in the Prometheus text exposition format,
+// without pulling in the full client library
+package prometheus
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Collector is anything that can write its samples to a scrape
+type Collector interface {
+	Collect(writer *Writer)
+}
+
+// Registry holds the collectors written on each scrape, in the order they were registered
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make([]Collector, 0)}
+}
+
+func (this *Registry) Register(collectors ...Collector) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.collectors = append(this.collectors, collectors...)
+}
+
+func (this *Registry) Write(out io.Writer) error {
+	this.mutex.Lock()
+	collectors := append([]Collector{}, this.collectors...)
+	this.mutex.Unlock()
+	writer := &Writer{out: bufio.NewWriter(out)}
+	for _, collector := range collectors {
+		collector.Collect(writer)
+	}
+	return writer.out.Flush()
+}
+
+// Writer formats samples, labels are given as name, value pairs
+type Writer struct {
+	out *bufio.Writer
+}
+
+func (this *Writer) Header(name string, help string, kind string) {
+	this.out.WriteString("# HELP " + name + " " + escape(help, false) + "\n")
+	this.out.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func (this *Writer) Sample(name string, value float64, labels ...string) {
+	this.out.WriteString(name)
+	if len(labels) > 1 {
+		this.out.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				this.out.WriteString(",")
+			}
+			this.out.WriteString(labels[i] + "=\"" + escape(labels[i+1], true) + "\"")
+		}
+		this.out.WriteString("}")
+	}
+	this.out.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// Counter is a monotonically increasing value for each combination of label values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+}
+
+// Inc adds one, values must line up with the label names the counter was made with
+func (this *Counter) Inc(values ...string) {
+	this.Add(1, values...)
+}
+
+func (this *Counter) Add(delta float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	value, ok := this.values[key]
+	if !ok {
+		value = &counterValue{labels: append([]string{}, values...)}
+		this.values[key] = value
+	}
+	value.value += delta
+}
+
+func (this *Counter) Collect(writer *Writer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	writer.Header(this.name, this.help, counterType)
+	for _, key := range sortedKeys(this.values) {
+		value := this.values[key]
+		writer.Sample(this.name, value.value, pairs(this.labels, value.labels)...)
+	}
+}
+
+// Func reads its samples when scraped, for values that are already kept elsewhere
+type Func struct {
+	name    string
+	help    string
+	kind    string
+	collect func(emit func(value float64, labels ...string))
+}
+
+// NewGaugeFunc makes a gauge that calls collect on each scrape,
+// emit takes the value followed by label name, value pairs
+func NewGaugeFunc(name string, help string, collect func(emit func(value float64, labels ...string))) *Func {
+	return &Func{name: name, help: help, kind: gaugeType, collect: collect}
+}
+
+// NewCounterFunc is like NewGaugeFunc, for values that only ever go up
+func NewCounterFunc(name string, help string, collect func(emit func(value float64, labels ...string))) *Func {
+	return &Func{name: name, help: help, kind: counterType, collect: collect}
+}
+
+func (this *Func) Collect(writer *Writer) {
+	writer.Header(this.name, this.help, this.kind)
+	this.collect(func(value float64, labels ...string) {
+		writer.Sample(this.name, value, labels...)
+	})
+}
+
+func pairs(names []string, values []string) []string {
+	labels := make([]string, 0, len(names)*2)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		labels = append(labels, name, value)
+	}
+	return labels
+}
+
+func sortedKeys(values interface{}) []string {
+	keys := make([]string, 0)
+	switch typed := values.(type) {
+	case map[string]*counterValue:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escape(value string, quoted bool) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\n", "\\n", -1)
+	if quoted {
+		value = strings.Replace(value, "\"", "\\\"", -1)
+	}
+	return value
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,66 @@
+package prometheus
+
+import (
+	"bytes"
+	"testing"
+)
+
+func scrape(t *testing.T, collectors ...Collector) string {
+	registry := NewRegistry()
+	registry.Register(collectors...)
+	var out bytes.Buffer
+	if err := registry.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter("dns_queries_total", "Queries answered", "type", "result")
+	counter.Inc("A", "cached")
+	counter.Inc("AAAA", "blocked")
+	counter.Add(2, "A", "cached")
+	expected := `# HELP dns_queries_total Queries answered
+# TYPE dns_queries_total counter
+dns_queries_total{type="AAAA",result="blocked"} 1
+dns_queries_total{type="A",result="cached"} 3
+`
+	if got := scrape(t, counter); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+// Bucket counts are cumulative and end with +Inf, which counts everything observed
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram("dns_latency_seconds", "Latency", []float64{1, 0.1}, "result")
+	histogram.Observe(0.05, "cached")
+	histogram.Observe(0.1, "cached")
+	histogram.Observe(0.5, "cached")
+	histogram.Observe(2, "cached")
+	expected := `# HELP dns_latency_seconds Latency
+# TYPE dns_latency_seconds histogram
+dns_latency_seconds_bucket{result="cached",le="0.1"} 2
+dns_latency_seconds_bucket{result="cached",le="1"} 3
+dns_latency_seconds_bucket{result="cached",le="+Inf"} 4
+dns_latency_seconds_sum{result="cached"} 2.65
+dns_latency_seconds_count{result="cached"} 4
+`
+	if got := scrape(t, histogram); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestFuncAndEscaping(t *testing.T) {
+	gauge := NewGaugeFunc("dns_cache_entries", "Entries in the cache\nby group", func(emit func(value float64, labels ...string)) {
+		emit(5, "group", `say "hi"\`)
+		emit(1)
+	})
+	expected := `# HELP dns_cache_entries Entries in the cache\nby group
+# TYPE dns_cache_entries gauge
+dns_cache_entries{group="say \"hi\"\\"} 5
+dns_cache_entries 1
+`
+	if got := scrape(t, gauge); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
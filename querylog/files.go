@@ -0,0 +1,107 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	GzipExtension = ".gz"
+	// rotatedFormat sorts the same alphabetically and by time
+	rotatedFormat = "20060102T150405.000"
+)
+
+// rotatedName puts the rotation time between the name and the extension, like queries-20200102T150405.000.jsonl
+func rotatedName(file string, now time.Time) string {
+	extension := filepath.Ext(file)
+	return strings.TrimSuffix(file, extension) + "-" + now.UTC().Format(rotatedFormat) + extension
+}
+
+// Files lists the log files oldest first, ending with the one being written.
+// A rotated file that is being compressed is listed once, as its finished .gz
+func Files(file string) ([]string, error) {
+	extension := filepath.Ext(file)
+	rotated, err := filepath.Glob(strings.TrimSuffix(file, extension) + "-*" + extension + "*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	compressed := make(map[string]bool)
+	for _, name := range rotated {
+		if strings.HasSuffix(name, extension+GzipExtension) {
+			compressed[strings.TrimSuffix(name, GzipExtension)] = true
+		}
+	}
+	files := make([]string, 0, len(rotated)+1)
+	for _, name := range rotated {
+		if (strings.HasSuffix(name, extension) && !compressed[name]) || strings.HasSuffix(name, extension+GzipExtension) {
+			files = append(files, name)
+		}
+	}
+	if _, err := os.Stat(file); err == nil {
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func compress(file string) error {
+	source, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.Create(file + GzipExtension + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(target.Name())
+	zipper := gzip.NewWriter(target)
+	if _, err = io.Copy(zipper, source); err != nil {
+		_ = target.Close()
+		return err
+	}
+	if err = zipper.Close(); err != nil {
+		_ = target.Close()
+		return err
+	}
+	if err = target.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(target.Name(), file+GzipExtension); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// prune removes the rotated files past MaxFiles or older than Retention
+func (this *Writer) prune() {
+	files, err := Files(this.options.File)
+	if err != nil {
+		this.log.Warnf("Could not list query logs: %s", err.Error())
+		return
+	}
+	// The file being written is never removed
+	rotated := files
+	if len(files) > 0 && files[len(files)-1] == this.options.File {
+		rotated = files[:len(files)-1]
+	}
+	cutoff := time.Now().Add(-this.options.Retention)
+	for i, name := range rotated {
+		remove := this.options.MaxFiles > 0 && len(rotated)-i > this.options.MaxFiles
+		if !remove && this.options.Retention > 0 {
+			if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+				remove = true
+			}
+		}
+		if remove {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				this.log.Warnf("Could not remove old query log %s: %s", name, err.Error())
+			}
+		}
+	}
+}
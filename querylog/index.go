@@ -0,0 +1,278 @@
+// Package querylog writes every DNS query to JSON lines files in the background,
+// rotating them by size and age and removing old ones
+package querylog
+
+import (
+	"bufio"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/kamackay/dns/logging"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultBuffer   = 4096
+	DefaultMaxBytes = 64 * 1024 * 1024
+	// flushInterval bounds how long an entry can sit in the buffer before it is on disk
+	flushInterval = time.Second
+	// reopenInterval is how often opening the file is retried after it failed
+	reopenInterval = 10 * time.Second
+)
+
+// Entry is one line of the query log
+type Entry struct {
+	// Time is in milliseconds
+	Time   int64  `json:"time"`
+	Client string `json:"client"`
+	Group  string `json:"group,omitempty"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Rcode  string `json:"rcode"`
+	Answer string `json:"answer,omitempty"`
+	Cname  string `json:"cname,omitempty"`
+	// Upstream is the server that answered, empty when the answer was not forwarded
+	Upstream string `json:"upstream,omitempty"`
+	// Latency is how long the answer took, in microseconds
+	Latency int64 `json:"latency"`
+	// Result is how the query was answered, like cached, forwarded, blocked or failed
+	Result string `json:"result"`
+	// Seq numbers the entries in the order they were written, set by the Writer
+	Seq int64 `json:"seq,omitempty"`
+}
+
+type Options struct {
+	File string
+	// MaxBytes and MaxAge start a new file once the current one is too big or too old, zero means never
+	MaxBytes int64
+	MaxAge   time.Duration
+	// MaxFiles and Retention remove rotated files past the count or age, zero means keep them
+	MaxFiles  int
+	Retention time.Duration
+	// Compress gzips files once they are rotated
+	Compress bool
+	// Buffer is how many entries can wait to be written, entries are dropped once it is full
+	Buffer int
+}
+
+// Writer appends entries from a background goroutine, so logging never slows down a query
+type Writer struct {
+	options Options
+	entries chan *Entry
+	dropped int64
+	done    chan struct{}
+	// closed is set under the write lock, so no entry is sent once entries is closed
+	closed bool
+	mutex  sync.RWMutex
+	log    *logrus.Logger
+
+	// file and writer are nil while the file cannot be opened, failed is when that was last tried
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+	failed time.Time
+	// seq starts at the time the log was opened in nanoseconds, so it keeps growing across restarts
+	seq int64
+	// rotated is the time the last rotated file is named after, so two rotations never share a name
+	rotated time.Time
+	// rotations is held while rotated files are compressed and pruned
+	rotations sync.WaitGroup
+}
+
+func Open(options Options) (*Writer, error) {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultBuffer
+	}
+	this := &Writer{
+		options: options,
+		entries: make(chan *Entry, options.Buffer),
+		done:    make(chan struct{}),
+		log:     logging.GetLogger(),
+		seq:     time.Now().UnixNano(),
+	}
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+	go this.run()
+	return this, nil
+}
+
+// Write queues the entry, returning false if it was dropped because the buffer is full or the log is closed
+func (this *Writer) Write(entry *Entry) bool {
+	if this == nil {
+		return false
+	}
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.closed {
+		return false
+	}
+	select {
+	case this.entries <- entry:
+		return true
+	default:
+		atomic.AddInt64(&this.dropped, 1)
+		return false
+	}
+}
+
+// Dropped is how many entries were not written because the buffer was full or the file could not be opened
+func (this *Writer) Dropped() int64 {
+	if this == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&this.dropped)
+}
+
+// Close writes out everything queued so far and closes the file, nothing can be written after
+func (this *Writer) Close() error {
+	if this == nil {
+		return nil
+	}
+	this.mutex.Lock()
+	if !this.closed {
+		this.closed = true
+		close(this.entries)
+	}
+	this.mutex.Unlock()
+	<-this.done
+	this.rotations.Wait()
+	return nil
+}
+
+func (this *Writer) File() string {
+	return this.options.File
+}
+
+func (this *Writer) run() {
+	defer close(this.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry, ok := <-this.entries:
+			if !ok {
+				this.closeFile()
+				return
+			}
+			this.write(entry)
+		case <-ticker.C:
+			if this.writer == nil && !this.reopen() {
+				continue
+			}
+			if err := this.writer.Flush(); err != nil {
+				this.log.Warnf("Could not flush query log: %s", err.Error())
+			}
+			if this.options.MaxAge > 0 && this.size > 0 && time.Since(this.opened) >= this.options.MaxAge {
+				this.rotate()
+			}
+		}
+	}
+}
+
+func (this *Writer) write(entry *Entry) {
+	// The entry may still be read by whoever queued it, so the number goes on a copy
+	this.seq++
+	numbered := *entry
+	numbered.Seq = this.seq
+	line, err := jsoniter.Marshal(&numbered)
+	if err != nil {
+		this.log.Warnf("Could not encode query log entry: %s", err.Error())
+		return
+	}
+	line = append(line, '\n')
+	if this.writer != nil && this.size > 0 && this.options.MaxBytes > 0 && this.size+int64(len(line)) > this.options.MaxBytes {
+		this.rotate()
+	}
+	if this.writer == nil && !this.reopen() {
+		atomic.AddInt64(&this.dropped, 1)
+		return
+	}
+	written, err := this.writer.Write(line)
+	this.size += int64(written)
+	if err != nil {
+		this.log.Warnf("Could not write query log: %s", err.Error())
+	}
+}
+
+func (this *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(this.options.File), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(this.options.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	this.file = file
+	this.writer = bufio.NewWriter(file)
+	this.size = info.Size()
+	this.opened = time.Now()
+	return nil
+}
+
+// reopen tries opening the file again once reopenInterval has passed since it last failed
+func (this *Writer) reopen() bool {
+	if time.Since(this.failed) < reopenInterval {
+		return false
+	}
+	if err := this.open(); err != nil {
+		this.failed = time.Now()
+		return false
+	}
+	this.log.Infof("Opened query log %s again, %d entries were dropped so far", this.options.File, this.Dropped())
+	return true
+}
+
+func (this *Writer) closeFile() {
+	if this.writer == nil {
+		return
+	}
+	if err := this.writer.Flush(); err != nil {
+		this.log.Warnf("Could not flush query log: %s", err.Error())
+	}
+	if err := this.file.Close(); err != nil {
+		this.log.Warnf("Could not close query log: %s", err.Error())
+	}
+}
+
+// rotate moves the current file aside and starts a new one.
+// Compressing and pruning happen in the background so queries keep being logged
+func (this *Writer) rotate() {
+	this.closeFile()
+	// Names are to the millisecond, a rotation within the same one would replace the file rotated before it
+	now := time.Now()
+	if !now.After(this.rotated.Add(time.Millisecond)) {
+		now = this.rotated.Add(time.Millisecond)
+	}
+	this.rotated = now
+	rotated := rotatedName(this.options.File, now)
+	if err := os.Rename(this.options.File, rotated); err != nil {
+		this.log.Warnf("Could not rotate query log: %s", err.Error())
+	}
+	if err := this.open(); err != nil {
+		// Keep going without a file rather than stopping the writer, entries are dropped until it opens again
+		this.log.Errorf("Could not open query log %s, dropping entries until it can be: %s", this.options.File, err.Error())
+		this.file = nil
+		this.writer = nil
+		this.failed = time.Now()
+	}
+	this.rotations.Add(1)
+	go func() {
+		defer this.rotations.Done()
+		if this.options.Compress {
+			if err := compress(rotated); err != nil {
+				this.log.Warnf("Could not compress %s: %s", rotated, err.Error())
+			}
+		}
+		this.prune()
+	}()
+}
@@ -0,0 +1,109 @@
+package querylog
+
+import (
+	"fmt"
+	"gitlab.com/kamackay/dns/logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func namedEntries(count int) []*Entry {
+	entries := make([]*Entry, count)
+	for i := range entries {
+		entries[i] = &Entry{Time: int64(i), Name: fmt.Sprintf("name%d.test.", i), Result: "forwarded"}
+	}
+	return entries
+}
+
+// Files rotate once they reach MaxBytes, and every entry can still be found in order
+func TestRotateBySize(t *testing.T) {
+	file := filepath.Join(tempDir(t), "queries.jsonl")
+	entries := namedEntries(20)
+	writer := writeEntries(t, Options{File: file, MaxBytes: 400}, entries)
+	files, err := Files(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("expected the log to rotate, got %v", files)
+	}
+	for _, name := range files {
+		if info, err := os.Stat(name); err != nil || info.Size() > 400 {
+			t.Errorf("expected %s to be at most 400 bytes, got %v, %v", name, info, err)
+		}
+	}
+	names, _ := searchAll(t, writer.File(), Query{}, 100)
+	if len(names) != len(entries) {
+		t.Fatalf("expected %d entries, got %v", len(entries), names)
+	}
+	for i, name := range names {
+		if name != entries[i].Name {
+			t.Errorf("expected %s at %d, got %s", entries[i].Name, i, name)
+		}
+	}
+}
+
+// Rotated files are compressed and only the newest MaxFiles are kept
+func TestRotateCompressesAndPrunes(t *testing.T) {
+	file := filepath.Join(tempDir(t), "queries.jsonl")
+	writer, err := Open(Options{File: file, MaxBytes: 200, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotated names are to the millisecond, so wait between entries to keep them apart
+	for _, entry := range namedEntries(12) {
+		writer.Write(entry)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := Files(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[2] != file {
+		t.Fatalf("expected 2 rotated files and the current one, got %v", files)
+	}
+	for _, name := range files[:2] {
+		if !strings.HasSuffix(name, GzipExtension) {
+			t.Errorf("expected %s to be compressed", name)
+		}
+	}
+	names, _ := searchAll(t, file, Query{}, 100)
+	if len(names) == 0 || names[len(names)-1] != "name11.test." {
+		t.Errorf("expected the kept files to end with the newest entry, got %v", names)
+	}
+}
+
+// Rotated files past the retention are removed, the current one never is
+func TestPruneByRetention(t *testing.T) {
+	dir := tempDir(t)
+	file := filepath.Join(dir, "queries.jsonl")
+	old := rotatedName(file, time.Now().Add(-48*time.Hour))
+	recent := rotatedName(file, time.Now().Add(-time.Hour))
+	for _, name := range []string{old, recent, file} {
+		if err := ioutil.WriteFile(name, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(old, time.Now(), time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	writer := &Writer{options: Options{File: file, Retention: 24 * time.Hour}, log: logging.GetLogger()}
+	writer.prune()
+	files, err := Files(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != recent || files[1] != file {
+		t.Errorf("expected only the old rotated file to be removed, got %v", files)
+	}
+}
@@ -0,0 +1,203 @@
+package querylog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"gitlab.com/kamackay/dns/wildcard"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLine is the longest line read back, anything longer was not written by this package
+const maxLine = 64 * 1024
+
+var ErrBadCursor = errors.New("invalid cursor")
+
+// Query filters the log, empty fields match everything
+type Query struct {
+	// From and To are milliseconds, inclusive, zero leaves that end open
+	From   int64
+	To     int64
+	Client string
+	// Domain is a substring of the name, or a wildcard like *.example.com
+	Domain  string
+	Type    string
+	Rcode   string
+	Result  string
+	Blocked *bool
+	// Cursor continues a previous search, as returned by Search
+	Cursor string
+}
+
+// Search calls emit with each matching entry, oldest first, until it returns false or limit entries were emitted.
+// The returned cursor continues after the last entry emitted, it is empty once there are no more matches.
+// The cursor is the Seq of that entry, which unlike the time never goes backwards from one line to the next
+func Search(file string, query Query, limit int, emit func(entry *Entry) bool) (string, error) {
+	after, err := parseCursor(query.Cursor)
+	if err != nil {
+		return "", err
+	}
+	files, err := Files(file)
+	if err != nil {
+		return "", err
+	}
+	matcher := NewMatcher(query)
+	last := after
+	emitted := 0
+	var previous time.Time
+	for _, name := range files {
+		rotated, isRotated := rotatedAt(file, name)
+		// A rotated file only holds entries from after the previous rotation up to its own
+		if (isRotated && query.From > 0 && rotated.UnixNano()/int64(time.Millisecond) < query.From) ||
+			(!previous.IsZero() && query.To > 0 && previous.UnixNano()/int64(time.Millisecond) > query.To) {
+			previous = rotated
+			continue
+		}
+		previous = rotated
+		more, err := scanFile(name, func(entry *Entry) bool {
+			if (after > 0 && entry.Seq <= after) || !matcher.Match(entry) {
+				return true
+			}
+			if emitted == limit {
+				// There is at least one more match, so the cursor is worth returning
+				return false
+			}
+			last = entry.Seq
+			emitted++
+			return emit(entry)
+		})
+		if err != nil {
+			return "", err
+		}
+		if !more {
+			if emitted == 0 {
+				return "", nil
+			}
+			return formatCursor(last), nil
+		}
+	}
+	return "", nil
+}
+
+// scanFile calls fn with each entry in the file, returning false if fn stopped early
+func scanFile(name string, fn func(entry *Entry) bool) (bool, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) && !strings.HasSuffix(name, GzipExtension) {
+		// Compressed since it was listed
+		file, err = os.Open(name + GzipExtension)
+		name += GzipExtension
+	}
+	if os.IsNotExist(err) {
+		// Rotated or pruned since it was listed
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(name, GzipExtension) {
+		zipped, err := gzip.NewReader(file)
+		if err != nil {
+			return false, fmt.Errorf("reading %s: %s", name, err.Error())
+		}
+		defer zipped.Close()
+		reader = zipped
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 4096), maxLine)
+	for scanner.Scan() {
+		var entry Entry
+		if err := jsoniter.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Most likely a line still being written
+			continue
+		}
+		if !fn(&entry) {
+			return false, nil
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("reading %s: %s", name, err.Error())
+	}
+	return true, nil
+}
+
+// rotatedAt reads the rotation time back out of a rotated file name
+func rotatedAt(file string, name string) (time.Time, bool) {
+	extension := filepath.Ext(file)
+	prefix := strings.TrimSuffix(file, extension) + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), GzipExtension), extension)
+	rotated, err := time.Parse(rotatedFormat, stamp)
+	return rotated, err == nil
+}
+
+// Matcher checks entries against a query, without its cursor
+type Matcher struct {
+	query   Query
+	pattern string
+}
+
+func NewMatcher(query Query) *Matcher {
+	query.Domain = strings.ToLower(query.Domain)
+	matcher := &Matcher{query: query}
+	if strings.Contains(query.Domain, "*") {
+		matcher.pattern = strings.TrimSuffix(query.Domain, ".") + "."
+	}
+	return matcher
+}
+
+func (this *Matcher) Match(entry *Entry) bool {
+	query := this.query
+	if (query.From > 0 && entry.Time < query.From) || (query.To > 0 && entry.Time > query.To) {
+		return false
+	}
+	if query.Client != "" && entry.Client != query.Client {
+		return false
+	}
+	if query.Type != "" && !strings.EqualFold(entry.Type, query.Type) {
+		return false
+	}
+	if query.Rcode != "" && !strings.EqualFold(entry.Rcode, query.Rcode) {
+		return false
+	}
+	if query.Result != "" && !strings.EqualFold(entry.Result, query.Result) {
+		return false
+	}
+	if query.Blocked != nil && (entry.Result == "blocked") != *query.Blocked {
+		return false
+	}
+	if this.pattern != "" {
+		return wildcard.Match(this.pattern, strings.ToLower(entry.Name))
+	}
+	return query.Domain == "" || strings.Contains(strings.ToLower(entry.Name), query.Domain)
+}
+
+func formatCursor(last int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(last, 10)))
+}
+
+// parseCursor returns the Seq to continue after, zero without a cursor
+func parseCursor(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return 0, ErrBadCursor
+	}
+	seq, err := strconv.ParseInt(string(decoded), 10, 64)
+	if err != nil || seq <= 0 {
+		return 0, ErrBadCursor
+	}
+	return seq, nil
+}
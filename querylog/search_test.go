@@ -0,0 +1,143 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func writeEntries(t *testing.T, options Options, entries []*Entry) *Writer {
+	writer, err := Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !writer.Write(entry) {
+			t.Fatalf("could not queue %s", entry.Name)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writer
+}
+
+func searchAll(t *testing.T, file string, query Query, limit int) ([]string, int) {
+	names := make([]string, 0)
+	pages := 0
+	for {
+		pages++
+		cursor, err := Search(file, query, limit, func(entry *Entry) bool {
+			names = append(names, entry.Name)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor == "" {
+			return names, pages
+		}
+		query.Cursor = cursor
+	}
+}
+
+// Entries are written from many goroutines, so their times are not in order in the file
+func TestSearchPagesOutOfOrderTimes(t *testing.T) {
+	file := filepath.Join(tempDir(t), "queries.jsonl")
+	times := []int64{1000, 1000, 1002, 999, 1002, 1001, 1000, 1003}
+	entries := make([]*Entry, len(times))
+	for i, at := range times {
+		entries[i] = &Entry{Time: at, Name: fmt.Sprintf("name%d.test.", i), Result: "cached"}
+	}
+	writeEntries(t, Options{File: file}, entries)
+
+	for limit := 1; limit <= len(entries); limit++ {
+		names, pages := searchAll(t, file, Query{}, limit)
+		if len(names) != len(entries) {
+			t.Errorf("pages of %d: expected %d entries, got %v", limit, len(entries), names)
+			continue
+		}
+		for i, name := range names {
+			if name != entries[i].Name {
+				t.Errorf("pages of %d: expected %s at %d, got %s", limit, entries[i].Name, i, name)
+			}
+		}
+		if expected := (len(entries) + limit - 1) / limit; pages != expected {
+			t.Errorf("pages of %d: expected %d pages, got %d", limit, expected, pages)
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	file := filepath.Join(tempDir(t), "queries.jsonl")
+	blocked := true
+	writeEntries(t, Options{File: file}, []*Entry{
+		{Time: 1, Name: "ads.example.", Client: "10.0.0.1", Type: "A", Result: "blocked"},
+		{Time: 2, Name: "www.example.", Client: "10.0.0.2", Type: "A", Result: "forwarded"},
+		{Time: 3, Name: "cdn.ads.example.", Client: "10.0.0.1", Type: "AAAA", Result: "blocked"},
+		{Time: 4, Name: "other.test.", Client: "10.0.0.1", Type: "A", Result: "cached"},
+	})
+	tests := []struct {
+		query    Query
+		expected string
+	}{
+		{Query{Domain: "*.ads.example"}, "cdn.ads.example."},
+		{Query{Domain: "example"}, "ads.example. www.example. cdn.ads.example."},
+		{Query{Client: "10.0.0.1", Type: "a"}, "ads.example. other.test."},
+		{Query{Blocked: &blocked}, "ads.example. cdn.ads.example."},
+		{Query{From: 2, To: 3}, "www.example. cdn.ads.example."},
+		{Query{Result: "cached"}, "other.test."},
+	}
+	for _, test := range tests {
+		names, _ := searchAll(t, file, test.query, 10)
+		if found := strings.Join(names, " "); found != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.query, test.expected, found)
+		}
+	}
+	if _, err := Search(file, Query{Cursor: "not a cursor"}, 10, func(*Entry) bool { return true }); err != ErrBadCursor {
+		t.Errorf("expected ErrBadCursor, got %v", err)
+	}
+}
+
+// While a rotated file is compressed, both it and its .gz exist for a moment
+func TestSearchSkipsFilesBeingCompressed(t *testing.T) {
+	dir := tempDir(t)
+	file := filepath.Join(dir, "queries.jsonl")
+	writeEntries(t, Options{File: file}, []*Entry{{Time: 1, Name: "old.test."}})
+	rotated := rotatedName(file, time.Now())
+	if err := os.Rename(file, rotated); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped, err := os.Create(rotated + GzipExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipper := gzip.NewWriter(zipped)
+	_, _ = zipper.Write(data)
+	_ = zipper.Close()
+	_ = zipped.Close()
+	writeEntries(t, Options{File: file}, []*Entry{{Time: 2, Name: "new.test."}})
+
+	names, _ := searchAll(t, file, Query{}, 10)
+	if found := strings.Join(names, " "); found != "old.test. new.test." {
+		t.Errorf("expected each entry once, got %q", found)
+	}
+}
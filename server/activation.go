@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ActivatedHttp is the name of sockets meant for the HTTP API, every other activated socket serves DNS
+const ActivatedHttp = "http"
+
+// activatedSockets were opened by the service manager and passed in, split by what they are for
+type activatedSockets struct {
+	dns  []*os.File
+	http []*os.File
+}
+
+// activation collects the sockets passed in by systemd, or by launchd on macOS.
+// Name them http with FileDescriptorName in the systemd socket unit, or as the key under Sockets in the launchd plist,
+// to serve the HTTP API on them. Launchd sockets for DNS go under the dns key
+func activation() (*activatedSockets, error) {
+	sockets := &activatedSockets{dns: make([]*os.File, 0), http: make([]*os.File, 0)}
+	files := systemdSockets()
+	if len(files) == 0 {
+		var err error
+		if files, err = launchdSockets(); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range files {
+		if file.Name() == ActivatedHttp {
+			sockets.http = append(sockets.http, file)
+		} else {
+			sockets.dns = append(sockets.dns, file)
+		}
+	}
+	return sockets, nil
+}
+
+// systemdSockets are the sockets from LISTEN_FDS, named by LISTEN_FDNAMES.
+// The variables are cleared so they are not passed on to anything this starts
+func systemdSockets() []*os.File {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, 0, count)
+	for i := 0; i < count; i++ {
+		// Passed sockets start after stdin, stdout and stderr
+		fd := 3 + i
+		name := "fd" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
+
+// activatedDnsServer serves DNS on a passed in socket, over TCP if it is a listener and UDP otherwise
+func activatedDnsServer(socket *os.File) (*dns.Server, error) {
+	defer socket.Close()
+	if listener, err := net.FileListener(socket); err == nil {
+		return &dns.Server{Net: "tcp", Listener: listener}, nil
+	}
+	conn, err := net.FilePacketConn(socket)
+	if err != nil {
+		return nil, fmt.Errorf("activated socket %s is not a TCP or UDP socket: %s", socket.Name(), err.Error())
+	}
+	return &dns.Server{Net: "udp", PacketConn: conn}, nil
+}
@@ -0,0 +1,40 @@
+//go:build cgo
+// +build cgo
+
+package server
+
+/*
+#include <errno.h>
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// launchdSockets are the sockets from the dns and http keys of the launchd plist
+func launchdSockets() ([]*os.File, error) {
+	files := make([]*os.File, 0)
+	for _, name := range []string{"dns", ActivatedHttp} {
+		cName := C.CString(name)
+		var fds *C.int
+		var count C.size_t
+		code := C.launch_activate_socket(cName, &fds, &count)
+		C.free(unsafe.Pointer(cName))
+		if code == C.ENOENT || code == C.ESRCH {
+			// The plist has no such socket, or this was not started by launchd
+			continue
+		} else if code != 0 {
+			return nil, fmt.Errorf("could not get the %s sockets from launchd: error %d", name, int(code))
+		}
+		for _, fd := range (*[1 << 16]C.int)(unsafe.Pointer(fds))[:count:count] {
+			files = append(files, os.NewFile(uintptr(fd), name))
+		}
+		C.free(unsafe.Pointer(fds))
+	}
+	return files, nil
+}
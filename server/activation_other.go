@@ -0,0 +1,11 @@
+//go:build !darwin || !cgo
+// +build !darwin !cgo
+
+package server
+
+import "os"
+
+// launchdSockets is only supported on macOS
+func launchdSockets() ([]*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,539 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/filter"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+type HostRequest struct {
+	// Target is an IP address, or a name to answer with as a CNAME
+	Target string `json:"target"`
+}
+
+type RuleRequest struct {
+	// Rule is an AdGuard/ABP style rule, allow rules start with @@
+	Rule string `json:"rule"`
+}
+
+type UpstreamsRequest struct {
+	Servers   []string `json:"servers"`
+	DohServer *string  `json:"dohServer"`
+}
+
+// FieldError is one reason a change was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned when a change is rejected, so a form can show each error by its field
+type ValidationErrors struct {
+	Error  string        `json:"error"`
+	Errors []*FieldError `json:"errors"`
+}
+
+var errNotConfigured = errors.New("not in the config")
+
+// configMutex keeps edits to the config file from overwriting each other
+var configMutex sync.Mutex
+
+// editConfig changes the config file and applies it. The file is edited as plain JSON in the order it was written,
+// so fields this version does not know about and fields left unset are kept as they were. A missing file starts empty
+func (this *Server) editConfig(edit func(raw *rawObject) error) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	raw := newRawObject()
+	data, err := ioutil.ReadFile(this.configFile)
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil && len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, raw)
+	}
+	if err != nil {
+		return err
+	}
+	if err = edit(raw); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return err
+	}
+	// Never write a config that could not be read back
+	if err = jsoniter.Unmarshal(data, &Config{}); err != nil {
+		return err
+	}
+	indented := bytes.Buffer{}
+	if err = json.Indent(&indented, data, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	if err = writeFileAtomic(this.configFile, indented.Bytes()); err != nil {
+		return err
+	}
+	this.loadConfig()
+	return nil
+}
+
+// rawObject is a JSON object that keeps its keys in the order they were read.
+// Values stay as they were read until they are replaced
+type rawObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newRawObject() *rawObject {
+	return &rawObject{keys: make([]string, 0), values: make(map[string]interface{})}
+}
+
+func (this *rawObject) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil {
+		return err
+	} else if token != json.Delim('{') {
+		return errors.New("expected a JSON object")
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var value json.RawMessage
+		if err = decoder.Decode(&value); err != nil {
+			return err
+		}
+		// Inside an object every other token is a key, which is always a string
+		this.set(token.(string), value)
+	}
+	_, err := decoder.Token()
+	return err
+}
+
+func (this *rawObject) MarshalJSON() ([]byte, error) {
+	buffer := bytes.Buffer{}
+	buffer.WriteByte('{')
+	for i, key := range this.keys {
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(this.values[key])
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(name)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+func (this *rawObject) has(key string) bool {
+	_, ok := this.values[key]
+	return ok
+}
+
+// set replaces the value of key, or adds it at the end
+func (this *rawObject) set(key string, value interface{}) {
+	if !this.has(key) {
+		this.keys = append(this.keys, key)
+	}
+	this.values[key] = value
+}
+
+func (this *rawObject) remove(key string) {
+	if !this.has(key) {
+		return
+	}
+	delete(this.values, key)
+	for i, existing := range this.keys {
+		if existing == key {
+			this.keys = append(this.keys[:i], this.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// object is the object under key, created if it is missing. Changes to it are kept in this one
+func (this *rawObject) object(key string) *rawObject {
+	if section, ok := this.values[key].(*rawObject); ok {
+		return section
+	}
+	section := newRawObject()
+	if value, ok := this.values[key].(json.RawMessage); !ok || json.Unmarshal(value, section) != nil {
+		section = newRawObject()
+	}
+	this.set(key, section)
+	return section
+}
+
+// list is the list of strings under key
+func (this *rawObject) list(key string) []string {
+	list := make([]string, 0)
+	values := make([]interface{}, 0)
+	if value, ok := this.values[key].(json.RawMessage); ok {
+		_ = json.Unmarshal(value, &values)
+	}
+	for _, value := range values {
+		if text, ok := value.(string); ok {
+			list = append(list, text)
+		}
+	}
+	return list
+}
+
+// Local hosts, block names, filter rules and upstreams can be changed here without editing the config file.
+// Every change is saved to the config file and applied before the response is sent. All of it needs the admin role
+func (this *Server) adminRoutes(engine *gin.Engine) {
+	admin := engine.Group("/admin")
+
+	admin.GET("/hosts", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, this.state().config.Hosts)
+	})
+
+	admin.GET("/hosts/:name", func(ctx *gin.Context) {
+		name := normalizeName(ctx.Param("name"))
+		target, ok := this.state().config.Hosts[name]
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": name + " is not in hosts"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"name": name, "target": target})
+	})
+
+	admin.PUT("/hosts/:name", func(ctx *gin.Context) {
+		var request HostRequest
+		if !bindAdminJSON(ctx, &request) {
+			return
+		}
+		name := normalizeName(ctx.Param("name"))
+		request.Target = strings.TrimSpace(request.Target)
+		if !validate(ctx, checkName("name", name), checkTarget(request.Target)) {
+			return
+		}
+		err := this.editConfig(func(raw *rawObject) error {
+			raw.object("hosts").set(name, request.Target)
+			return nil
+		})
+		if this.adminFailed(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"name": name, "target": request.Target})
+	})
+
+	admin.DELETE("/hosts/:name", func(ctx *gin.Context) {
+		this.deleteConfigKey(ctx, "hosts", normalizeName(ctx.Param("name")))
+	})
+
+	admin.GET("/blocks", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, this.state().config.Blocks)
+	})
+
+	admin.PUT("/blocks/:name", func(ctx *gin.Context) {
+		name := normalizeName(ctx.Param("name"))
+		if !validate(ctx, checkName("name", name)) {
+			return
+		}
+		err := this.editConfig(func(raw *rawObject) error {
+			raw.object("blocks").set(name, true)
+			return nil
+		})
+		if this.adminFailed(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"name": name, "blocked": true})
+	})
+
+	admin.DELETE("/blocks/:name", func(ctx *gin.Context) {
+		this.deleteConfigKey(ctx, "blocks", normalizeName(ctx.Param("name")))
+	})
+
+	// Filter rules in the top level config, both blocking and allow (@@) rules
+	admin.GET("/rules", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, this.ruleList())
+	})
+
+	admin.POST("/rules", func(ctx *gin.Context) {
+		var request RuleRequest
+		if !bindAdminJSON(ctx, &request) {
+			return
+		}
+		this.addRule(ctx, strings.TrimSpace(request.Rule))
+	})
+
+	admin.DELETE("/rules", func(ctx *gin.Context) {
+		this.removeRule(ctx, strings.TrimSpace(ctx.Query("rule")))
+	})
+
+	// Allow rules for a whole domain, a shorthand for @@||domain^ in the rules
+	admin.GET("/allow", func(ctx *gin.Context) {
+		allowed := make([]string, 0)
+		for _, rule := range this.ruleList() {
+			if strings.HasPrefix(rule, "@@") {
+				allowed = append(allowed, rule)
+			}
+		}
+		ctx.JSON(http.StatusOK, allowed)
+	})
+
+	admin.PUT("/allow/:name", func(ctx *gin.Context) {
+		name := normalizeName(ctx.Param("name"))
+		if !validate(ctx, checkName("name", name)) {
+			return
+		}
+		this.addRule(ctx, allowRule(name))
+	})
+
+	admin.DELETE("/allow/:name", func(ctx *gin.Context) {
+		this.removeRule(ctx, allowRule(normalizeName(ctx.Param("name"))))
+	})
+
+	admin.GET("/upstreams", func(ctx *gin.Context) {
+		config := this.state().config
+		ctx.JSON(http.StatusOK, &UpstreamsRequest{Servers: config.DnsServers, DohServer: config.DohServer})
+	})
+
+	// Replace the upstream servers, an empty dohServer stops using DNS over HTTPS
+	admin.PUT("/upstreams", func(ctx *gin.Context) {
+		var request UpstreamsRequest
+		if !bindAdminJSON(ctx, &request) {
+			return
+		}
+		problems := make([]*FieldError, 0)
+		if len(request.Servers) == 0 {
+			problems = append(problems, &FieldError{Field: "servers", Message: "at least one server is required"})
+		}
+		for i, server := range request.Servers {
+			request.Servers[i] = strings.TrimSpace(server)
+			problems = append(problems, checkServer("servers", request.Servers[i]))
+		}
+		if request.DohServer != nil && strings.ContainsAny(*request.DohServer, " /") {
+			problems = append(problems, &FieldError{Field: "dohServer", Value: *request.DohServer,
+				Message: "must be a host name or address, without a scheme or path"})
+		}
+		if !validate(ctx, problems...) {
+			return
+		}
+		err := this.editConfig(func(raw *rawObject) error {
+			raw.set("servers", unique(request.Servers))
+			if request.DohServer == nil || *request.DohServer == "" {
+				raw.remove("dohServer")
+			} else {
+				raw.set("dohServer", *request.DohServer)
+			}
+			return nil
+		})
+		if this.adminFailed(ctx, err) {
+			return
+		}
+		config := this.state().config
+		ctx.JSON(http.StatusOK, &UpstreamsRequest{Servers: config.DnsServers, DohServer: config.DohServer})
+	})
+
+	admin.POST("/upstreams/:server", func(ctx *gin.Context) {
+		server := ctx.Param("server")
+		if !validate(ctx, checkServer("server", server)) {
+			return
+		}
+		err := this.editConfig(func(raw *rawObject) error {
+			raw.set("servers", unique(append(raw.list("servers"), server)))
+			return nil
+		})
+		if this.adminFailed(ctx, err) {
+			return
+		}
+		ctx.JSON(http.StatusOK, this.state().config.DnsServers)
+	})
+
+	admin.DELETE("/upstreams/:server", func(ctx *gin.Context) {
+		server := ctx.Param("server")
+		err := this.editConfig(func(raw *rawObject) error {
+			servers := raw.list("servers")
+			remaining := make([]string, 0, len(servers))
+			for _, configured := range servers {
+				if configured != server {
+					remaining = append(remaining, configured)
+				}
+			}
+			if len(remaining) == len(servers) {
+				return errNotConfigured
+			}
+			if len(remaining) == 0 {
+				return &FieldError{Field: "server", Value: server, Message: "the last server cannot be removed"}
+			}
+			raw.set("servers", remaining)
+			return nil
+		})
+		if err == errNotConfigured {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": server + " is not in servers"})
+			return
+		} else if this.adminFailed(ctx, err) {
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+}
+
+func (this *Server) ruleList() []string {
+	rules := this.state().config.Rules
+	if rules == nil {
+		rules = make([]string, 0)
+	}
+	return rules
+}
+
+func (this *Server) addRule(ctx *gin.Context, rule string) {
+	if !validate(ctx, checkRule(rule)) {
+		return
+	}
+	err := this.editConfig(func(raw *rawObject) error {
+		raw.set("rules", unique(append(raw.list("rules"), rule)))
+		return nil
+	})
+	if this.adminFailed(ctx, err) {
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"rule": rule})
+}
+
+func (this *Server) removeRule(ctx *gin.Context, rule string) {
+	err := this.editConfig(func(raw *rawObject) error {
+		rules := raw.list("rules")
+		remaining := make([]string, 0, len(rules))
+		for _, configured := range rules {
+			if configured != rule {
+				remaining = append(remaining, configured)
+			}
+		}
+		if len(remaining) == len(rules) {
+			return errNotConfigured
+		}
+		raw.set("rules", remaining)
+		return nil
+	})
+	if err == errNotConfigured {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": rule + " is not in rules"})
+		return
+	} else if this.adminFailed(ctx, err) {
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (this *Server) deleteConfigKey(ctx *gin.Context, section string, name string) {
+	err := this.editConfig(func(raw *rawObject) error {
+		values := raw.object(section)
+		if !values.has(name) {
+			return errNotConfigured
+		}
+		values.remove(name)
+		return nil
+	})
+	if err == errNotConfigured {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": name + " is not in " + section})
+		return
+	} else if this.adminFailed(ctx, err) {
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// adminFailed sends the error from a config edit, if there was one
+func (this *Server) adminFailed(ctx *gin.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if problem, ok := err.(*FieldError); ok {
+		validate(ctx, problem)
+		return true
+	}
+	this.log.Errorf("Could not save the config: %s", err.Error())
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": "could not save the config: " + err.Error()})
+	return true
+}
+
+func bindAdminJSON(ctx *gin.Context, request interface{}) bool {
+	if err := ctx.ShouldBindJSON(request); err != nil {
+		validate(ctx, &FieldError{Field: "body", Message: err.Error()})
+		return false
+	}
+	return true
+}
+
+// validate sends the problems found, ignoring nils, and reports whether there were none
+func validate(ctx *gin.Context, problems ...*FieldError) bool {
+	found := make([]*FieldError, 0)
+	for _, problem := range problems {
+		if problem != nil {
+			found = append(found, problem)
+		}
+	}
+	if len(found) == 0 {
+		return true
+	}
+	ctx.JSON(http.StatusBadRequest, &ValidationErrors{Error: "validation failed", Errors: found})
+	return false
+}
+
+func (this *FieldError) Error() string {
+	return this.Field + ": " + this.Message
+}
+
+// checkName accepts a domain name, which may start with a *. wildcard
+func checkName(field string, name string) *FieldError {
+	if name == "." {
+		return &FieldError{Field: field, Message: "is required"}
+	}
+	if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok || strings.Contains(name, " ") {
+		return &FieldError{Field: field, Value: name, Message: "is not a valid domain name"}
+	}
+	return nil
+}
+
+func checkTarget(target string) *FieldError {
+	if target == "" {
+		return &FieldError{Field: "target", Message: "is required"}
+	}
+	if net.ParseIP(target) != nil {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(target); !ok || strings.ContainsAny(target, " *") {
+		return &FieldError{Field: "target", Value: target, Message: "must be an IP address or a domain name"}
+	}
+	return nil
+}
+
+func checkServer(field string, server string) *FieldError {
+	if net.ParseIP(server) == nil {
+		return &FieldError{Field: field, Value: server, Message: "must be an IP address"}
+	}
+	return nil
+}
+
+func checkRule(rule string) *FieldError {
+	if _, err := filter.Parse(rule); err == filter.ErrEmptyRule || err == filter.ErrIgnored {
+		return &FieldError{Field: "rule", Value: rule, Message: "does not block or allow anything: " + err.Error()}
+	} else if err != nil {
+		return &FieldError{Field: "rule", Value: rule, Message: err.Error()}
+	}
+	return nil
+}
+
+func allowRule(name string) string {
+	return "@@||" + strings.TrimSuffix(strings.TrimPrefix(name, "*."), ".") + "^"
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Edits keep the keys of the config file in the order they were written
+func TestEditConfigKeepsOrder(t *testing.T) {
+	srvr := newTestServer(t, `{
+  "servers": ["127.0.0.9"],
+  "unknownSetting": {"b": 1, "a": 2},
+  "hosts": {"z.test.": "10.0.0.1", "a.test.": "10.0.0.2"},
+  "blocks": {"blocked.test.": true}
+}`)
+	err := srvr.editConfig(func(raw *rawObject) error {
+		raw.object("hosts").set("m.test.", "10.0.0.3")
+		raw.object("blocks").remove("blocked.test.")
+		raw.set("rules", []string{"||ads.test^"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(srvr.configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []string{`"servers"`, `"unknownSetting"`, `"b"`, `"a"`, `"hosts"`, `"z.test."`, `"a.test."`, `"m.test."`, `"blocks"`, `"rules"`}
+	last := -1
+	for _, key := range order {
+		at := strings.Index(string(data), key)
+		if at <= last {
+			t.Fatalf("expected %s after the keys before it in\n%s", key, data)
+		}
+		last = at
+	}
+	if strings.Contains(string(data), "blocked.test.") {
+		t.Errorf("blocked.test. should have been removed from\n%s", data)
+	}
+	if srvr.state().hosts["m.test."] == nil {
+		t.Errorf("the edit should have been applied")
+	}
+}
+
+// A missing config file is edited as if it were empty
+func TestEditConfigWithoutFile(t *testing.T) {
+	srvr := newTestServer(t, testConfig)
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	srvr.configFile = filepath.Join(dir, "config.json")
+	err = srvr.editConfig(func(raw *rawObject) error {
+		raw.object("hosts").set("nas.test.", "10.0.0.2")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := readConfig(srvr.configFile)
+	if err != nil || config.Hosts["nas.test."] != "10.0.0.2" {
+		t.Errorf("expected the new file to have the host, got %v, %v", config, err)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"gitlab.com/kamackay/dns/oidc"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+	// DefaultRoleClaim is the OIDC claim holding the groups a user is in
+	DefaultRoleClaim = "groups"
+	// PasswordCacheTime is how long a checked password is remembered, since bcrypt is slow on purpose
+	PasswordCacheTime = 5 * time.Minute
+)
+
+// authenticator is the compiled form of the auth config
+type authenticator struct {
+	tokens   []*ApiToken
+	users    map[string]*ApiUser
+	oidc     *oidc.Verifier
+	settings *OidcConfig
+	// passwords are the hashes of recently checked user and password pairs, and when they expire
+	passwords sync.Map
+}
+
+// newAuth compiles the auth config, keeping the OIDC keys of the previous one if the issuer did not change
+func (this *Server) newAuth(config *Config, previous *authenticator) *authenticator {
+	auth := &authenticator{
+		tokens: make([]*ApiToken, 0),
+		users:  make(map[string]*ApiUser),
+	}
+	if config.AdminToken != "" {
+		auth.tokens = append(auth.tokens, &ApiToken{Name: "adminToken", Token: config.AdminToken, Role: RoleAdmin})
+	}
+	if config.Auth == nil {
+		return auth
+	}
+	for _, token := range config.Auth.Tokens {
+		if token.Token == "" || !validRole(token.Role) {
+			this.log.Warnf("Ignoring API token %s, it needs a token and a role of read or admin", token.Name)
+			continue
+		}
+		auth.tokens = append(auth.tokens, token)
+	}
+	for _, user := range config.Auth.Users {
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil || !validRole(user.Role) {
+			this.log.Warnf("Ignoring API user %s, it needs a bcrypt password hash and a role of read or admin", user.Name)
+			continue
+		}
+		auth.users[user.Name] = user
+	}
+	if settings := config.Auth.Oidc; settings != nil && settings.Issuer != "" {
+		auth.settings = settings
+		if previous != nil && previous.settings != nil &&
+			previous.settings.Issuer == settings.Issuer && previous.settings.ClientId == settings.ClientId {
+			auth.oidc = previous.oidc
+		} else {
+			auth.oidc = oidc.New(settings.Issuer, settings.ClientId)
+		}
+	}
+	return auth
+}
+
+func validRole(role string) bool {
+	return role == RoleRead || role == RoleAdmin
+}
+
+// enabled is false when no way to sign in is configured, which leaves the API open
+func (this *authenticator) enabled() bool {
+	return len(this.tokens) > 0 || len(this.users) > 0 || this.oidc != nil
+}
+
+// authenticate finds who sent the request and their role, an empty role if they could not be identified
+func (this *authenticator) authenticate(request *http.Request) (string, string) {
+	header := request.Header.Get("Authorization")
+	if user, password, ok := request.BasicAuth(); ok {
+		return user, this.checkPassword(user, password)
+	}
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", ""
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	role, name := "", ""
+	// Every token is compared, so the time taken does not give away which one was close
+	for _, configured := range this.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(configured.Token)) == 1 {
+			role, name = configured.Role, configured.Name
+		}
+	}
+	if role != "" || this.oidc == nil || strings.Count(token, ".") != 2 {
+		return name, role
+	}
+	claims, err := this.oidc.Verify(token)
+	if err != nil {
+		return "", ""
+	}
+	return claims.String("sub"), this.claimRole(claims)
+}
+
+func (this *authenticator) checkPassword(name string, password string) string {
+	user, ok := this.users[name]
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + password + "\x00" + user.PasswordHash))
+	key := hex.EncodeToString(sum[:])
+	if expires, ok := this.passwords.Load(key); ok && time.Now().Before(expires.(time.Time)) {
+		return user.Role
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return ""
+	}
+	this.passwords.Store(key, time.Now().Add(PasswordCacheTime))
+	return user.Role
+}
+
+// claimRole gives admin to members of an admin group, and read to members of a read group,
+// or to everyone the issuer vouches for if there are no read groups
+func (this *authenticator) claimRole(claims oidc.Claims) string {
+	claim := this.settings.RoleClaim
+	if claim == "" {
+		claim = DefaultRoleClaim
+	}
+	for _, group := range this.settings.AdminGroups {
+		if claims.Has(claim, group) {
+			return RoleAdmin
+		}
+	}
+	if len(this.settings.ReadGroups) == 0 {
+		return RoleRead
+	}
+	for _, group := range this.settings.ReadGroups {
+		if claims.Has(claim, group) {
+			return RoleRead
+		}
+	}
+	return ""
+}
+
+// requiredRole is read for looking and admin for changing anything, the dashboard page itself is open
+// since it only shows what the API lets it load
+func requiredRole(request *http.Request) string {
+	path := request.URL.Path
+	switch {
+	case request.Method == http.MethodOptions || path == "/dashboard":
+		return ""
+	case strings.HasPrefix(path, "/admin/") ||
+		(request.Method != http.MethodGet && request.Method != http.MethodHead):
+		return RoleAdmin
+	}
+	return RoleRead
+}
+
+// authorize checks the caller has the role the request needs
+func (this *Server) authorize(ctx *gin.Context) {
+	required := requiredRole(ctx.Request)
+	auth := this.state().auth
+	if required == "" {
+		ctx.Next()
+		return
+	}
+	if !auth.enabled() {
+		if strings.HasPrefix(ctx.Request.URL.Path, "/admin/") {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the admin API is disabled until auth is configured"})
+			return
+		}
+		ctx.Next()
+		return
+	}
+	name, role := auth.authenticate(ctx.Request)
+	if role == "" {
+		this.log.Warnf("Rejected %s %s from %s, not signed in", ctx.Request.Method, ctx.Request.URL.Path, ctx.ClientIP())
+		if len(auth.users) > 0 && ctx.GetHeader("X-Requested-With") == "" {
+			// Lets a browser ask for a user and password, but not when a script will ask itself
+			ctx.Writer.Header().Add("WWW-Authenticate", `Basic realm="dns"`)
+		}
+		ctx.Writer.Header().Add("WWW-Authenticate", `Bearer realm="dns"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "sign in with a token or a user and password"})
+		return
+	}
+	if required == RoleAdmin && role != RoleAdmin {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "the admin role is required"})
+		return
+	}
+	if required == RoleAdmin {
+		this.log.Infof("%s %s by %s", ctx.Request.Method, ctx.Request.URL.Path, name)
+	}
+	ctx.Set(gin.AuthUserKey, name)
+	ctx.Next()
+}
+
+// corsPolicy only lets the configured origins call the API from a browser, none if there are none.
+// Requests from the server's own pages are not cross origin, so they are always allowed
+func (this *Server) corsPolicy() gin.HandlerFunc {
+	return cors.New(cors.Config{
+		AllowOriginFunc: func(origin string) bool {
+			for _, allowed := range this.state().config.CorsOrigins {
+				if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+					return true
+				}
+			}
+			return false
+		},
+		AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowHeaders: []string{"Origin", "Content-Type", "Authorization", "X-Requested-With"},
+		MaxAge:       12 * time.Hour,
+	})
+}
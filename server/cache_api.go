@@ -0,0 +1,181 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/wildcard"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+	MaxPrewarmNames = 500
+	// PrewarmConcurrency is how many prewarm lookups run at once, across all requests
+	PrewarmConcurrency = 8
+)
+
+// CacheEntry is a cached answer as shown by the cache API
+type CacheEntry struct {
+	Key string `json:"key"`
+	// Group is empty for answers from the shared upstreams
+	Group   string  `json:"group,omitempty"`
+	Expires int64   `json:"expires"`
+	TtlLeft int64   `json:"ttlLeft"`
+	Expired bool    `json:"expired"`
+	Domain  *Domain `json:"domain"`
+}
+
+type CachePage struct {
+	Total   int           `json:"total"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Entries []*CacheEntry `json:"entries"`
+}
+
+type PrewarmRequest struct {
+	Names []string `json:"names"`
+	Group string   `json:"group"`
+}
+
+func (this *Server) cacheRoutes(engine *gin.Engine) {
+	// List cached answers, filter is a name or wildcard like *.example.com
+	engine.GET("/cache", func(ctx *gin.Context) {
+		offset, _ := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+		limit, _ := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(DefaultPageSize)))
+		if offset < 0 {
+			offset = 0
+		}
+		if limit <= 0 || limit > MaxPageSize {
+			limit = DefaultPageSize
+		}
+		pattern := ""
+		if filter := ctx.Query("filter"); filter != "" {
+			pattern = normalizeName(filter)
+		}
+		group, groupSet := ctx.GetQuery("group")
+		entries := this.cacheEntries(func(name string, scope string) bool {
+			return (pattern == "" || wildcard.Match(pattern, name)) && (!groupSet || scope == group)
+		})
+		page := &CachePage{
+			Total:   len(entries),
+			Offset:  offset,
+			Limit:   limit,
+			Entries: make([]*CacheEntry, 0),
+		}
+		if offset < len(entries) {
+			end := offset + limit
+			if end > len(entries) {
+				end = len(entries)
+			}
+			page.Entries = entries[offset:end]
+		}
+		ctx.JSON(http.StatusOK, page)
+	})
+
+	// Show every cached answer for a name, across groups
+	engine.GET("/cache/:name", func(ctx *gin.Context) {
+		name := normalizeName(ctx.Param("name"))
+		entries := this.cacheEntries(func(entryName string, _ string) bool {
+			return entryName == name
+		})
+		if len(entries) == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "not cached", "name": name})
+			return
+		}
+		ctx.JSON(http.StatusOK, entries)
+	})
+
+	// Remove a name, or every name matching a wildcard. *.example.com removes example.com as well
+	engine.DELETE("/cache/:name", func(ctx *gin.Context) {
+		pattern := normalizeName(ctx.Param("name"))
+		apex := strings.TrimPrefix(pattern, "*.")
+		deleted := this.domains.DeleteFunc(func(key string, _ interface{}) bool {
+			name, _ := splitCacheKey(key)
+			return name == apex || wildcard.Match(pattern, name)
+		})
+		ctx.JSON(http.StatusOK, gin.H{"deleted": deleted})
+	})
+
+	// Look names up upstream in the background, so the first client to ask is answered from the cache
+	engine.POST("/cache/prewarm", func(ctx *gin.Context) {
+		var request PrewarmRequest
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(request.Names) > MaxPrewarmNames {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "too many names", "max": MaxPrewarmNames})
+			return
+		}
+		policy := this.state().defaultPolicy
+		if request.Group != "" {
+			policy = this.policyByName(request.Group)
+			if policy.Name != request.Group {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "unknown group", "group": request.Group})
+				return
+			}
+		}
+		names := make([]string, len(request.Names))
+		for i, name := range request.Names {
+			names[i] = normalizeName(name)
+		}
+		go this.prewarm(policy, names)
+		ctx.JSON(http.StatusAccepted, gin.H{"accepted": len(names), "group": policy.Name})
+	})
+}
+
+// prewarm fetches the names, no more than PrewarmConcurrency at a time
+func (this *Server) prewarm(policy *Policy, names []string) {
+	for _, name := range names {
+		this.prewarming <- true
+		go func(name string) {
+			defer func() { <-this.prewarming }()
+			if _, err := this.fetch(policy, name); err != nil {
+				this.logFor(nil, name).Warnf("Could not prewarm %s: %s", name, err.Error())
+			}
+		}(name)
+	}
+}
+
+// cacheEntries collects the cached answers the filter accepts, sorted by key
+func (this *Server) cacheEntries(accept func(name string, scope string) bool) []*CacheEntry {
+	now := time.Now()
+	entries := make([]*CacheEntry, 0)
+	this.domains.Range(func(key string, value interface{}, expires time.Time) bool {
+		name, scope := splitCacheKey(key)
+		if !accept(name, scope) {
+			return true
+		}
+		left := expires.Sub(now)
+		entries = append(entries, &CacheEntry{
+			Key:     key,
+			Group:   scope,
+			Expires: expires.UnixNano() / NanoConv,
+			TtlLeft: int64(left / time.Second),
+			Expired: left <= 0,
+			Domain:  copyDomain(value.(*Domain)),
+		})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// splitCacheKey is the reverse of Policy.cacheKey
+func splitCacheKey(key string) (string, string) {
+	if i := strings.LastIndex(key, "@"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+func normalizeName(name string) string {
+	return dns.Fqdn(strings.ToLower(strings.TrimSpace(name)))
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"gitlab.com/kamackay/dns/services"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CheckConfig reads a config file and finds everything in it that would be ignored or fail when serving.
+// The error is for a file that can not be read at all
+func CheckConfig(file string) ([]*FieldError, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err = jsoniter.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	problems := make([]*FieldError, 0)
+	add := func(problem *FieldError) {
+		if problem != nil {
+			problems = append(problems, problem)
+		}
+	}
+	// Misspelled settings are otherwise silently left out
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&Config{}); err != nil {
+		add(&FieldError{Field: "config", Message: err.Error()})
+	}
+	hosts := make([]string, 0, len(config.Hosts))
+	for name := range config.Hosts {
+		hosts = append(hosts, name)
+	}
+	sort.Strings(hosts)
+	for _, name := range hosts {
+		add(checkHostName("hosts", name))
+		add(checkTarget(fmt.Sprint(config.Hosts[name])))
+	}
+	checkBlocks(add, "blocks", config.Blocks)
+	checkServers(add, "servers", config.DnsServers)
+	checkRules(add, "rules", config.Rules)
+	checkFilterLists(add, "filterLists", config.FilterLists)
+	schedules := make([]string, 0, len(config.Schedules))
+	for name := range config.Schedules {
+		schedules = append(schedules, name)
+	}
+	sort.Strings(schedules)
+	for _, name := range schedules {
+		definition := config.Schedules[name]
+		if definition == nil {
+			continue
+		}
+		if _, err := parseSchedule(name, definition); err != nil {
+			add(&FieldError{Field: "schedules." + name, Message: err.Error()})
+		}
+	}
+	checkScheduledBlocks(add, "scheduledBlocks", config.Schedules, config.ScheduledBlocks)
+	catalog, err := services.Load(config.ServicesFile)
+	if err != nil {
+		add(&FieldError{Field: "servicesFile", Value: config.ServicesFile, Message: err.Error()})
+	}
+	checkServices(add, "blockedServices", catalog, config.BlockedServices)
+	groups := make(map[string]bool)
+	for i, group := range config.Groups {
+		if group == nil {
+			continue
+		}
+		field := fmt.Sprintf("groups[%d]", i)
+		if group.Name == "" || group.Name == DefaultPolicy || groups[group.Name] {
+			add(&FieldError{Field: field + ".name", Value: group.Name, Message: "must be unique, and not " + DefaultPolicy})
+		}
+		groups[group.Name] = true
+		for _, ip := range group.Ips {
+			if parseSubnet(ip) == nil {
+				add(&FieldError{Field: field + ".ips", Value: ip, Message: "must be an IP address or CIDR range"})
+			}
+		}
+		for _, mac := range group.Macs {
+			if _, err := net.ParseMAC(mac); err != nil {
+				add(&FieldError{Field: field + ".macs", Value: mac, Message: "must be a MAC address"})
+			}
+		}
+		checkBlocks(add, field+".blocks", group.Blocks)
+		checkServers(add, field+".servers", group.DnsServers)
+		checkRules(add, field+".rules", group.Rules)
+		checkFilterLists(add, field+".filterLists", group.FilterLists)
+		if _, ok := config.Schedules[group.Schedule]; group.Schedule != "" && !ok {
+			add(&FieldError{Field: field + ".schedule", Value: group.Schedule, Message: "is not in schedules"})
+		}
+		checkScheduledBlocks(add, field+".scheduledBlocks", config.Schedules, group.ScheduledBlocks)
+		checkServices(add, field+".blockedServices", catalog, group.BlockedServices)
+	}
+	checkListen(add, &config)
+	if config.Http != nil && config.Http.Tls != nil {
+		if _, err := newCertificates(config.Http.Tls); err != nil {
+			add(&FieldError{Field: "http.tls", Message: err.Error()})
+		}
+	}
+	if config.Auth != nil {
+		for i, token := range config.Auth.Tokens {
+			if token.Token == "" || !validRole(token.Role) {
+				add(&FieldError{Field: fmt.Sprintf("auth.tokens[%d]", i), Value: token.Name, Message: "needs a token and a role of read or admin"})
+			}
+		}
+		for i, user := range config.Auth.Users {
+			if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil || !validRole(user.Role) {
+				add(&FieldError{Field: fmt.Sprintf("auth.users[%d]", i), Value: user.Name, Message: "needs a bcrypt password hash and a role of read or admin"})
+			}
+		}
+		if settings := config.Auth.Oidc; settings != nil && settings.Issuer != "" && !strings.HasPrefix(settings.Issuer, "https://") {
+			add(&FieldError{Field: "auth.oidc.issuer", Value: settings.Issuer, Message: "must be an https URL"})
+		}
+	}
+	return problems, nil
+}
+
+// checkHostName accepts what hosts and blocks can match, a domain name with wildcards or a regex starting with ^
+func checkHostName(field string, name string) *FieldError {
+	if strings.HasPrefix(name, "^") {
+		if _, err := regexp.Compile(name); err != nil {
+			return &FieldError{Field: field, Value: name, Message: err.Error()}
+		}
+		return nil
+	}
+	return checkName(field, strings.Replace(name, "*", "x", -1))
+}
+
+func checkBlocks(add func(*FieldError), field string, blocks map[string]bool) {
+	names := make([]string, 0, len(blocks))
+	for name := range blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(checkHostName(field, name))
+	}
+}
+
+func checkServers(add func(*FieldError), field string, servers []string) {
+	for _, server := range servers {
+		add(checkServer(field, server))
+	}
+}
+
+func checkRules(add func(*FieldError), field string, rules []string) {
+	for _, rule := range rules {
+		if problem := checkRule(rule); problem != nil {
+			problem.Field = field
+			add(problem)
+		}
+	}
+}
+
+// checkFilterLists only checks files exist, lists on the web are fetched when serving
+func checkFilterLists(add func(*FieldError), field string, sources []string) {
+	for _, source := range sources {
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			continue
+		}
+		if _, err := os.Stat(source); err != nil {
+			add(&FieldError{Field: field, Value: source, Message: err.Error()})
+		}
+	}
+}
+
+func checkScheduledBlocks(add func(*FieldError), field string, schedules map[string]*Schedule, blocks []*ScheduledBlock) {
+	for i, block := range blocks {
+		if block == nil {
+			continue
+		}
+		if _, ok := schedules[block.Schedule]; !ok {
+			add(&FieldError{Field: fmt.Sprintf("%s[%d].schedule", field, i), Value: block.Schedule, Message: "is not in schedules"})
+		}
+		checkRules(add, fmt.Sprintf("%s[%d].rules", field, i), block.Rules)
+	}
+}
+
+func checkServices(add func(*FieldError), field string, catalog services.Catalog, names []string) {
+	for _, name := range names {
+		if _, ok := catalog[strings.ToLower(name)]; !ok {
+			add(&FieldError{Field: field, Value: name, Message: "is not in the services catalog"})
+		}
+	}
+}
+
+func checkListen(add func(*FieldError), config *Config) {
+	listen := config.Listen
+	if listen == nil {
+		listen = &ListenConfig{}
+	}
+	http := []string{DefaultHttpListen}
+	if config.Http != nil && len(config.Http.Listen) > 0 {
+		http = config.Http.Listen
+	}
+	for _, group := range []struct {
+		field     string
+		addresses []string
+	}{{"listen.udp", listen.Udp}, {"listen.tcp", listen.Tcp}, {"http.listen", http}} {
+		for _, address := range group.addresses {
+			if _, err := expandAddress("tcp", address, !listen.DisableIpv4, !listen.DisableIpv6); err != nil {
+				add(&FieldError{Field: group.field, Value: address, Message: err.Error()})
+			}
+		}
+	}
+}
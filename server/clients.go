@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/dns_resolver"
+	"gitlab.com/kamackay/dns/filter"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPolicy = "default"
+	// EdnsClientIdOption is the EDNS0 local option that carries a client ID
+	EdnsClientIdOption = 65074
+	ArpRefresh         = 30 * time.Second
+	ArpFile            = "/proc/net/arp"
+	// NeighborCommand lists the IPv6 neighbors, which are not in ArpFile
+	NeighborCommand = "ip"
+)
+
+// buildPolicies builds the default policy and one for each group, with the schedules they use
+func (this *Server) buildPolicies(config *Config, resolver *dns_resolver.DnsResolver) (*Policy, []*Policy, map[string]*schedule) {
+	defaultFilters := this.loadFilters(config.Rules, config.FilterLists)
+	schedules := this.buildSchedules(config)
+	defaultScheduled := this.buildScheduledBlocks(schedules, config.ScheduledBlocks)
+	catalog := this.buildCatalog(config)
+	defaultServices := this.selectServices(catalog, config.BlockedServices)
+	defaultPolicy := &Policy{
+		Name:       DefaultPolicy,
+		blocks:     config.Blocks,
+		filters:    defaultFilters,
+		resolver:   resolver,
+		scheduled:  defaultScheduled,
+		safeSearch: config.SafeSearch,
+		services:   defaultServices,
+	}
+	policies := make([]*Policy, 0)
+	for _, group := range config.Groups {
+		if group == nil {
+			continue
+		}
+		policy := &Policy{
+			Name:       group.Name,
+			group:      group,
+			blocks:     config.Blocks,
+			filters:    defaultFilters,
+			resolver:   resolver,
+			scheduled:  defaultScheduled,
+			safeSearch: config.SafeSearch,
+			services:   defaultServices,
+			macs:       make(map[string]bool),
+			ids:        make(map[string]bool),
+			subnets:    make([]*net.IPNet, 0),
+		}
+		if group.SafeSearch != nil {
+			policy.safeSearch = *group.SafeSearch
+		}
+		if group.BlockedServices != nil {
+			policy.services = this.selectServices(catalog, group.BlockedServices)
+		}
+		if group.Schedule != "" {
+			policy.schedule = schedules[group.Schedule]
+			if policy.schedule == nil {
+				this.log.Warnf("Unknown Schedule %s for group %s, group disabled", group.Schedule, group.Name)
+				continue
+			}
+		}
+		if group.ScheduledBlocks != nil {
+			policy.scheduled = this.buildScheduledBlocks(schedules, group.ScheduledBlocks)
+		}
+		if group.Blocks != nil {
+			policy.blocks = group.Blocks
+		}
+		if len(group.Rules) > 0 || len(group.FilterLists) > 0 {
+			policy.filters = this.loadFilters(group.Rules, group.FilterLists)
+		}
+		if len(group.DnsServers) > 0 || group.DohServer != nil {
+			servers := group.DnsServers
+			if len(servers) == 0 {
+				servers = config.DnsServers
+			}
+			policy.resolver = this.newResolver(servers, group.DohServer)
+			// Answers from other upstreams may differ, so keep them apart in the cache
+			policy.cacheScope = group.Name
+		}
+		for _, ip := range group.Ips {
+			if subnet := parseSubnet(ip); subnet != nil {
+				policy.subnets = append(policy.subnets, subnet)
+			} else {
+				this.log.Warnf("Invalid IP %s in group %s", ip, group.Name)
+			}
+		}
+		for _, mac := range group.Macs {
+			if hw, err := net.ParseMAC(mac); err == nil {
+				policy.macs[hw.String()] = true
+			} else {
+				this.log.Warnf("Invalid MAC %s in group %s", mac, group.Name)
+			}
+		}
+		for _, id := range group.ClientIds {
+			policy.ids[strings.ToLower(id)] = true
+		}
+		policies = append(policies, policy)
+	}
+	return defaultPolicy, policies, schedules
+}
+
+// identifyClient works out who sent the request and which policy applies to them.
+// Client IDs are checked first, then MACs, then addresses, each in config order.
+// Groups outside of their schedule are skipped
+func (this *Server) identifyClient(addr net.Addr, r *dns.Msg) *Client {
+	current := this.state()
+	client := &Client{
+		Ip:     getRemoteIp(addr),
+		Id:     getClientId(r),
+		Policy: current.defaultPolicy,
+	}
+	now := time.Now()
+	policies := make([]*Policy, 0, len(current.policies))
+	for _, policy := range current.policies {
+		if policy.schedule.active(now) {
+			policies = append(policies, policy)
+		}
+	}
+	if client.Id != "" {
+		for _, policy := range policies {
+			if policy.ids[client.Id] {
+				client.Policy = policy
+				return client
+			}
+		}
+	}
+	if client.Ip == nil {
+		return client
+	}
+	for _, policy := range policies {
+		if len(policy.macs) == 0 {
+			continue
+		}
+		if client.Mac == "" {
+			client.Mac = this.arp.lookup(client.Ip)
+			if client.Mac == "" {
+				break
+			}
+		}
+		if policy.macs[client.Mac] {
+			client.Policy = policy
+			return client
+		}
+	}
+	for _, policy := range policies {
+		for _, subnet := range policy.subnets {
+			if subnet.Contains(client.Ip) {
+				client.Policy = policy
+				return client
+			}
+		}
+	}
+	return client
+}
+
+// policyByName finds the current policy with the given name, the default policy if there is none
+func (this *Server) policyByName(name string) *Policy {
+	current := this.state()
+	for _, policy := range current.policies {
+		if policy.Name == name {
+			return policy
+		}
+	}
+	return current.defaultPolicy
+}
+
+// cacheKey scopes cached answers to the upstreams that gave them
+func (this *Policy) cacheKey(domainName string) string {
+	if this.cacheScope == "" {
+		return domainName
+	}
+	return domainName + "@" + this.cacheScope
+}
+
+// filterClient describes the client to $client filter rules, which can name the group
+func (this *Client) filterClient() *filter.Client {
+	name := ""
+	if this.Policy != nil && this.Policy.group != nil {
+		name = this.Policy.Name
+	}
+	return &filter.Client{Ip: this.Ip, Name: name}
+}
+
+func getClientId(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == EdnsClientIdOption {
+			return strings.ToLower(strings.TrimSpace(string(local.Data)))
+		}
+	}
+	return ""
+}
+
+func parseSubnet(value string) *net.IPNet {
+	if _, subnet, err := net.ParseCIDR(value); err == nil {
+		return subnet
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// arpTable is a periodically refreshed copy of the kernel neighbor table
+type arpTable struct {
+	mutex   sync.Mutex
+	entries map[string]string
+	loaded  time.Time
+}
+
+func newArpTable() *arpTable {
+	return &arpTable{entries: make(map[string]string)}
+}
+
+func (this *arpTable) lookup(ip net.IP) string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if time.Since(this.loaded) > ArpRefresh {
+		this.reload()
+	}
+	return this.entries[ip.String()]
+}
+
+func (this *arpTable) reload() {
+	this.loaded = time.Now()
+	entries := make(map[string]string)
+	readArpFile(entries)
+	readNeighbors(entries)
+	this.entries = entries
+}
+
+// readArpFile reads the IPv4 entries of the kernel ARP table
+func readArpFile(entries map[string]string) {
+	file, err := os.Open(ArpFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		// Incomplete entries show up with an all zero address
+		if hw, err := net.ParseMAC(fields[3]); err == nil && fields[3] != "00:00:00:00:00:00" {
+			entries[fields[0]] = hw.String()
+		}
+	}
+}
+
+// readNeighbors reads the IPv6 neighbor table, lines look like
+// "fe80::1 dev eth0 lladdr 00:11:22:33:44:55 router REACHABLE"
+func readNeighbors(entries map[string]string) {
+	output, err := exec.Command(NeighborCommand, "-6", "neigh", "show").Output()
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+			if hw, err := net.ParseMAC(fields[i+1]); err == nil {
+				entries[ip.String()] = hw.String()
+			}
+			break
+		}
+	}
+}
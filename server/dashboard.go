@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"gitlab.com/kamackay/dns/dashboard"
+	"gitlab.com/kamackay/dns/util"
+	"net/http"
+	"sync/atomic"
+)
+
+func (this *Server) dashboardRoutes(engine *gin.Engine) {
+	engine.GET("/dashboard", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, dashboard.ContentType, []byte(dashboard.Page))
+	})
+
+	// Everything the dashboard shows that is not in the history, reports or query log
+	engine.GET("/status", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, this.status())
+	})
+}
+
+func (this *Server) status() *Status {
+	current := this.state()
+	status := &Status{
+		Started:         this.stats.Started / NanoConv,
+		Running:         util.PrintTimeDiff(this.stats.Started),
+		TotalRequests:   atomic.LoadInt64(&this.stats.TotalRequests),
+		LookupRequests:  atomic.LoadInt64(&this.stats.LookupRequests),
+		CachedRequests:  atomic.LoadInt64(&this.stats.CachedRequests),
+		BlockedRequests: atomic.LoadInt64(&this.stats.BlockedRequests),
+		FailedRequests:  atomic.LoadInt64(&this.stats.FailedRequests),
+		Cache:           this.domains.Stats(),
+		BlockList: BlockListStatus{
+			Rules:  current.blockList.Len(),
+			Pulled: current.blockListPulled,
+		},
+		Groups:          make([]*GroupStatus, 0),
+		Hosts:           len(current.hosts),
+		Upstreams:       this.upstreams.list(),
+		ActiveSchedules: this.activeSchedules(),
+		QueryLog:        this.queryLog != nil,
+	}
+	for _, policy := range this.allPolicies() {
+		status.Groups = append(status.Groups, &GroupStatus{
+			Name:   policy.Name,
+			Rules:  policy.filters.Len(),
+			Blocks: len(policy.blocks),
+		})
+	}
+	return status
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/dns_resolver"
+	"gitlab.com/kamackay/dns/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+// exporter keeps the Prometheus metrics that are not already counted in the stats
+type exporter struct {
+	registry        *prometheus.Registry
+	queries         *prometheus.Counter
+	answerLatency   *prometheus.Histogram
+	upstreamLatency *prometheus.Histogram
+	upstreamErrors  *prometheus.Counter
+}
+
+func (this *Server) newExporter() *exporter {
+	metrics := &exporter{
+		registry: prometheus.NewRegistry(),
+		queries: prometheus.NewCounter("dns_queries_total",
+			"DNS queries by type, response code and how they were answered",
+			"qtype", "rcode", "result"),
+		answerLatency: prometheus.NewHistogram("dns_answer_duration_seconds",
+			"Time taken to answer a DNS query", prometheus.DefaultBuckets, "result"),
+		upstreamLatency: prometheus.NewHistogram("dns_upstream_duration_seconds",
+			"Time taken by each upstream server to answer", prometheus.DefaultBuckets, "server"),
+		upstreamErrors: prometheus.NewCounter("dns_upstream_errors_total",
+			"Upstream queries that failed without an answer", "server"),
+	}
+	metrics.registry.Register(
+		metrics.queries,
+		metrics.answerLatency,
+		metrics.upstreamLatency,
+		metrics.upstreamErrors,
+		this.counterFunc("dns_coalesced_requests_total",
+			"Queries that shared an upstream lookup already in flight", &this.stats.CoalescedRequests),
+		this.counterFunc("dns_stale_requests_total",
+			"Queries answered with a stale answer while upstreams were unreachable", &this.stats.StaleRequests),
+		this.counterFunc("dns_prefetch_requests_total",
+			"Popular answers refreshed before they expired", &this.stats.PrefetchRequests),
+		prometheus.NewGaugeFunc("dns_cache_entries", "Answers in the cache",
+			func(emit func(float64, ...string)) {
+				emit(float64(this.domains.Stats().Entries))
+			}),
+		prometheus.NewGaugeFunc("dns_cache_bytes", "Estimated memory used by the cache",
+			func(emit func(float64, ...string)) {
+				emit(float64(this.domains.Stats().Bytes))
+			}),
+		prometheus.NewCounterFunc("dns_cache_lookups_total", "Cache lookups by whether they were a hit",
+			func(emit func(float64, ...string)) {
+				stats := this.domains.Stats()
+				emit(float64(stats.Hits), "result", "hit")
+				emit(float64(stats.Misses), "result", "miss")
+			}),
+		prometheus.NewCounterFunc("dns_cache_removals_total", "Answers removed from the cache by reason",
+			func(emit func(float64, ...string)) {
+				stats := this.domains.Stats()
+				emit(float64(stats.Evictions), "reason", "evicted")
+				emit(float64(stats.Expired), "reason", "expired")
+			}),
+		prometheus.NewGaugeFunc("dns_blocklist_rules", "Rules in the pulled block list",
+			func(emit func(float64, ...string)) {
+				emit(float64(this.state().blockList.Len()))
+			}),
+		prometheus.NewGaugeFunc("dns_filter_rules", "Filter rules for each group",
+			func(emit func(float64, ...string)) {
+				for _, policy := range this.allPolicies() {
+					emit(float64(policy.filters.Len()), "group", policy.Name)
+				}
+			}),
+		prometheus.NewGaugeFunc("dns_blocked_domains", "Blocked domains in the config for each group",
+			func(emit func(float64, ...string)) {
+				for _, policy := range this.allPolicies() {
+					emit(float64(len(policy.blocks)), "group", policy.Name)
+				}
+			}),
+		prometheus.NewGaugeFunc("dns_hosts", "Local hosts from the config",
+			func(emit func(float64, ...string)) {
+				emit(float64(len(this.state().hosts)))
+			}),
+		prometheus.NewCounterFunc("dns_query_log_dropped_total", "Queries left out of the query log because it fell behind",
+			func(emit func(float64, ...string)) {
+				emit(float64(this.queryLog.Dropped()))
+			}),
+	)
+	return metrics
+}
+
+func (this *Server) counterFunc(name string, help string, counter *int64) *prometheus.Func {
+	return prometheus.NewCounterFunc(name, help, func(emit func(float64, ...string)) {
+		emit(float64(atomic.LoadInt64(counter)))
+	})
+}
+
+// newResolver makes a resolver that reports its upstream latency to the exporter and the upstream health
+func (this *Server) newResolver(servers []string, dohServer *string) *dns_resolver.DnsResolver {
+	resolver := dns_resolver.New(servers, dohServer)
+	resolver.Observer = func(server string, took time.Duration, err error) {
+		this.exporter.observeUpstream(server, took, err)
+		this.upstreams.observe(server, took, err)
+	}
+	return resolver
+}
+
+func (this *Server) allPolicies() []*Policy {
+	current := this.state()
+	return append([]*Policy{current.defaultPolicy}, current.policies...)
+}
+
+func (this *exporter) observeAnswer(qtype uint16, rcode int, result string, took int64) {
+	this.queries.Inc(typeName(qtype), dns.RcodeToString[rcode], result)
+	this.answerLatency.Observe(time.Duration(took).Seconds(), result)
+}
+
+func (this *exporter) observeUpstream(server string, took time.Duration, err error) {
+	if err != nil {
+		this.upstreamErrors.Inc(server)
+		return
+	}
+	this.upstreamLatency.Observe(took.Seconds(), server)
+}
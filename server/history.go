@@ -0,0 +1,352 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HistoryVersion is bumped whenever the history file format changes, older files are ignored
+const HistoryVersion = 1
+
+const (
+	ResolutionMinute = "minute"
+	ResolutionHour   = "hour"
+	ResolutionDay    = "day"
+	// historyDomainSlack is how many times TopDomains an open bucket may track before it is trimmed
+	historyDomainSlack = 10
+)
+
+// DefaultHistoryRange is how far back the history endpoint goes when no from is given
+const DefaultHistoryRange = 24 * time.Hour
+
+// HistoryBucket counts the queries that started in one period
+type HistoryBucket struct {
+	// Start is in milliseconds, like the metric times
+	Start     int64 `json:"start"`
+	Queries   int64 `json:"queries"`
+	Cached    int64 `json:"cached"`
+	Forwarded int64 `json:"forwarded"`
+	Blocked   int64 `json:"blocked"`
+	Failed    int64 `json:"failed"`
+	// Domains are the most queried names, counts are approximate once a bucket has been trimmed
+	Domains map[string]int64 `json:"domains"`
+}
+
+type HistoryRange struct {
+	Resolution string           `json:"resolution"`
+	From       int64            `json:"from"`
+	To         int64            `json:"to"`
+	Totals     *HistoryBucket   `json:"totals"`
+	Buckets    []*HistoryBucket `json:"buckets"`
+}
+
+// historySeries is the history at one resolution, oldest bucket first
+type historySeries struct {
+	Resolution string           `json:"resolution"`
+	Buckets    []*HistoryBucket `json:"buckets"`
+	step       time.Duration
+	keep       time.Duration
+}
+
+// history keeps the same counts at every resolution, so coarser series outlive the finer ones
+type history struct {
+	mutex  sync.Mutex
+	top    int
+	series []*historySeries
+}
+
+type historyFile struct {
+	Version int              `json:"version"`
+	Saved   int64            `json:"saved"`
+	Series  []*historySeries `json:"series"`
+}
+
+func newHistory(config *HistoryConfig) *history {
+	if config == nil {
+		config = &HistoryConfig{}
+	}
+	top := config.TopDomains
+	if top <= 0 {
+		top = DefaultHistoryTopDomains
+	}
+	retention := func(value int, unit time.Duration, fallback time.Duration) time.Duration {
+		if value > 0 {
+			return time.Duration(value) * unit
+		}
+		return fallback
+	}
+	return &history{
+		top: top,
+		series: []*historySeries{
+			{Resolution: ResolutionMinute, step: time.Minute,
+				keep: retention(config.MinuteRetentionHours, time.Hour, DefaultMinuteRetention)},
+			{Resolution: ResolutionHour, step: time.Hour,
+				keep: retention(config.HourRetentionDays, 24*time.Hour, DefaultHourRetention)},
+			{Resolution: ResolutionDay, step: 24 * time.Hour,
+				keep: retention(config.DayRetentionDays, 24*time.Hour, DefaultDayRetention)},
+		},
+	}
+}
+
+// record counts one answered query, result is one of the Result constants
+func (this *history) record(result string, domainName string, now time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, series := range this.series {
+		bucket := this.current(series, now)
+		bucket.Queries++
+		switch result {
+		case ResultCached, ResultStale:
+			bucket.Cached++
+		case ResultForwarded:
+			bucket.Forwarded++
+		case ResultBlocked:
+			bucket.Blocked++
+		case ResultFailed:
+			bucket.Failed++
+		}
+		if domainName == "" {
+			continue
+		}
+		bucket.Domains[domainName]++
+		if len(bucket.Domains) > this.top*historyDomainSlack {
+			trimDomains(bucket.Domains, this.top)
+		}
+	}
+}
+
+// current returns the bucket now falls in, closing the previous one and dropping expired ones
+func (this *history) current(series *historySeries, now time.Time) *HistoryBucket {
+	start := now.Truncate(series.step).UnixNano() / NanoConv
+	if count := len(series.Buckets); count > 0 && series.Buckets[count-1].Start == start {
+		return series.Buckets[count-1]
+	} else if count > 0 {
+		trimDomains(series.Buckets[count-1].Domains, this.top)
+	}
+	series.Buckets = expireBuckets(series.Buckets, now.Add(-series.keep))
+	bucket := &HistoryBucket{Start: start, Domains: make(map[string]int64)}
+	series.Buckets = append(series.Buckets, bucket)
+	return bucket
+}
+
+func expireBuckets(buckets []*HistoryBucket, cutoff time.Time) []*HistoryBucket {
+	oldest := cutoff.UnixNano() / NanoConv
+	i := 0
+	for i < len(buckets) && buckets[i].Start < oldest {
+		i++
+	}
+	return buckets[i:]
+}
+
+// trimDomains keeps only the top most queried domains
+func trimDomains(domains map[string]int64, top int) {
+	if len(domains) <= top {
+		return
+	}
+	for _, name := range sortByCount(domains)[top:] {
+		delete(domains, name)
+	}
+}
+
+// sortByCount orders the names most counted first
+func sortByCount(domains map[string]int64) []string {
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if domains[names[i]] == domains[names[j]] {
+			return names[i] < names[j]
+		}
+		return domains[names[i]] > domains[names[j]]
+	})
+	return names
+}
+
+// query returns the buckets starting between from and to, at the given resolution.
+// With no resolution, the finest one that still covers from is used
+func (this *history) query(resolution string, from time.Time, to time.Time) (*HistoryRange, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	series := this.pick(resolution, from)
+	if series == nil {
+		return nil, fmt.Errorf("unknown resolution %s", resolution)
+	}
+	result := &HistoryRange{
+		Resolution: series.Resolution,
+		From:       from.UnixNano() / NanoConv,
+		To:         to.UnixNano() / NanoConv,
+		Totals:     &HistoryBucket{Start: from.UnixNano() / NanoConv, Domains: make(map[string]int64)},
+		Buckets:    make([]*HistoryBucket, 0),
+	}
+	first := from.Truncate(series.step).UnixNano() / NanoConv
+	for _, bucket := range series.Buckets {
+		if bucket.Start < first || bucket.Start > result.To {
+			continue
+		}
+		copied := *bucket
+		copied.Domains = make(map[string]int64, len(bucket.Domains))
+		for name, count := range bucket.Domains {
+			copied.Domains[name] = count
+			result.Totals.Domains[name] += count
+		}
+		trimDomains(copied.Domains, this.top)
+		result.Buckets = append(result.Buckets, &copied)
+		result.Totals.Queries += bucket.Queries
+		result.Totals.Cached += bucket.Cached
+		result.Totals.Forwarded += bucket.Forwarded
+		result.Totals.Blocked += bucket.Blocked
+		result.Totals.Failed += bucket.Failed
+	}
+	trimDomains(result.Totals.Domains, this.top)
+	return result, nil
+}
+
+// pick finds the series for a resolution, the series are kept finest first
+func (this *history) pick(resolution string, from time.Time) *historySeries {
+	for _, series := range this.series {
+		if series.Resolution == resolution || (resolution == "" && !from.Before(time.Now().Add(-series.keep))) {
+			return series
+		}
+	}
+	if resolution == "" {
+		return this.series[len(this.series)-1]
+	}
+	return nil
+}
+
+func (this *Server) historyFile() string {
+	config := this.state().config
+	if config.History == nil {
+		return ""
+	}
+	return config.History.File
+}
+
+func (this *Server) saveHistory() error {
+	file := this.historyFile()
+	if file == "" {
+		return nil
+	}
+	this.history.mutex.Lock()
+	data, err := json.Marshal(&historyFile{
+		Version: HistoryVersion,
+		Saved:   time.Now().UnixNano(),
+		Series:  this.history.series,
+	})
+	this.history.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(file, data); err != nil {
+		return err
+	}
+	this.log.Debugf("Saved History to %s", file)
+	return nil
+}
+
+// loadHistory restores the saved buckets, keeping the retention from the current config
+func (this *Server) loadHistory() error {
+	file := this.historyFile()
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved historyFile
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if saved.Version != HistoryVersion {
+		return fmt.Errorf("unsupported history version %d", saved.Version)
+	}
+	now := time.Now()
+	this.history.mutex.Lock()
+	defer this.history.mutex.Unlock()
+	for _, series := range this.history.series {
+		for _, loaded := range saved.Series {
+			if loaded == nil || loaded.Resolution != series.Resolution {
+				continue
+			}
+			buckets := make([]*HistoryBucket, 0, len(loaded.Buckets))
+			for _, bucket := range loaded.Buckets {
+				if bucket == nil {
+					continue
+				}
+				if bucket.Domains == nil {
+					bucket.Domains = make(map[string]int64)
+				}
+				buckets = append(buckets, bucket)
+			}
+			sort.Slice(buckets, func(i, j int) bool {
+				return buckets[i].Start < buckets[j].Start
+			})
+			series.Buckets = expireBuckets(buckets, now.Add(-series.keep))
+		}
+	}
+	this.log.Infof("Loaded History from %s, saved %s ago",
+		file, time.Since(time.Unix(0, saved.Saved)).Round(time.Second))
+	return nil
+}
+
+// persistHistory saves the history periodically, so a crash loses at most one interval
+func (this *Server) persistHistory() {
+	for {
+		interval := DefaultHistoryInterval
+		if config := this.state().config; config.History != nil && config.History.IntervalSeconds > 0 {
+			interval = time.Duration(config.History.IntervalSeconds) * time.Second
+		}
+		time.Sleep(interval)
+		if err := this.saveHistory(); err != nil {
+			this.log.Errorf("Could not save history: %s", err.Error())
+		}
+	}
+}
+
+func (this *Server) historyRoutes(engine *gin.Engine) {
+	// from and to are milliseconds or RFC 3339 times, resolution is minute, hour or day
+	engine.GET("/history", func(ctx *gin.Context) {
+		to, err := parseTimeParam(ctx.Query("to"), time.Now())
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+			return
+		}
+		from, err := parseTimeParam(ctx.Query("from"), to.Add(-DefaultHistoryRange))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+			return
+		}
+		if from.After(to) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "from is after to"})
+			return
+		}
+		result, err := this.history.query(ctx.Query("resolution"), from, to)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, result)
+	})
+}
+
+func parseTimeParam(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*NanoConv), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryBuckets(t *testing.T) {
+	history := newHistory(&HistoryConfig{TopDomains: 2})
+	start := time.Now().Add(-2 * time.Hour).Truncate(time.Hour)
+	history.record(ResultCached, "a.test.", start)
+	history.record(ResultForwarded, "b.test.", start.Add(30*time.Second))
+	history.record(ResultBlocked, "a.test.", start.Add(time.Minute))
+	history.record(ResultStale, "c.test.", start.Add(time.Hour))
+	history.record(ResultFailed, "", start.Add(time.Hour))
+
+	minutes, err := history.query(ResolutionMinute, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minutes.Buckets) != 3 {
+		t.Fatalf("expected 3 minute buckets, got %d", len(minutes.Buckets))
+	}
+	first := minutes.Buckets[0]
+	if first.Queries != 2 || first.Cached != 1 || first.Forwarded != 1 || first.Domains["a.test."] != 1 {
+		t.Errorf("unexpected first bucket %+v", first)
+	}
+	totals := minutes.Totals
+	if totals.Queries != 5 || totals.Cached != 2 || totals.Forwarded != 1 || totals.Blocked != 1 || totals.Failed != 1 {
+		t.Errorf("unexpected totals %+v", totals)
+	}
+	if len(totals.Domains) != 2 || totals.Domains["a.test."] != 2 {
+		t.Errorf("expected the top 2 domains led by a.test., got %v", totals.Domains)
+	}
+
+	hours, err := history.query(ResolutionHour, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours.Buckets) != 2 || hours.Buckets[0].Queries != 3 || hours.Buckets[1].Queries != 2 {
+		t.Errorf("expected hour buckets of 3 and 2 queries, got %+v", hours.Buckets)
+	}
+	if _, err = history.query("week", start, start); err == nil {
+		t.Errorf("expected an unknown resolution to fail")
+	}
+}
+
+// Without a resolution the finest series that still reaches back to from is used
+func TestHistoryPicksResolution(t *testing.T) {
+	history := newHistory(&HistoryConfig{MinuteRetentionHours: 1, HourRetentionDays: 2})
+	now := time.Now()
+	cases := map[time.Duration]string{
+		30 * time.Minute:      ResolutionMinute,
+		3 * time.Hour:         ResolutionHour,
+		72 * time.Hour:        ResolutionDay,
+		1000 * 24 * time.Hour: ResolutionDay,
+	}
+	for ago, expected := range cases {
+		result, err := history.query("", now.Add(-ago), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Resolution != expected {
+			t.Errorf("from %s ago: expected %s, got %s", ago, expected, result.Resolution)
+		}
+	}
+}
+
+// Buckets older than the retention are dropped as new ones open
+func TestHistoryExpiresBuckets(t *testing.T) {
+	history := newHistory(&HistoryConfig{MinuteRetentionHours: 1})
+	now := time.Now()
+	history.record(ResultCached, "old.test.", now.Add(-2*time.Hour))
+	history.record(ResultCached, "new.test.", now)
+	minutes := history.series[0]
+	if len(minutes.Buckets) != 1 || minutes.Buckets[0].Domains["new.test."] != 1 {
+		t.Errorf("expected only the new minute bucket, got %+v", minutes.Buckets)
+	}
+	if hours := history.series[1]; len(hours.Buckets) != 2 {
+		t.Errorf("expected the hour series to keep both buckets, got %d", len(hours.Buckets))
+	}
+}
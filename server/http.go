@@ -1,17 +1,19 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/avct/uasurfer"
-	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
-	"github.com/jinzhu/copier"
 	jsoniter "github.com/json-iterator/go"
+	"gitlab.com/kamackay/dns/prometheus"
 	"gitlab.com/kamackay/dns/util"
+	"net"
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 )
 
 func (this *Server) startRest(flush func() error) {
@@ -20,8 +22,10 @@ func (this *Server) startRest(flush func() error) {
 		gin.SetMode(gin.ReleaseMode)
 		engine := gin.New()
 		engine.Use(gin.Recovery())
-		engine.Use(gzip.Gzip(gzip.BestCompression))
-		engine.Use(cors.Default())
+		// Query log results are streamed, which compression would hold back
+		engine.Use(gzip.Gzip(gzip.BestCompression, gzip.WithExcludedPaths([]string{"/querylog"})))
+		engine.Use(this.corsPolicy())
+		engine.Use(this.authorize)
 
 		engine.GET("/", func(ctx *gin.Context) {
 			send := func(json interface{}) {
@@ -43,24 +47,17 @@ func (this *Server) startRest(flush func() error) {
 					"json": strings.TrimSpace(string(jsonData)),
 				})
 			}
-			var stats Stats
-			err := copier.Copy(&stats, &this.stats)
-			if err != nil {
-				// shrug
-				fmt.Printf("%+v", err)
-				send(gin.H{})
-				return
-			}
-			if ctx.Query("metrics") != "true" {
-				stats.Metrics = make([]Metric, 0)
-			}
+			stats := this.stats.snapshot(ctx.Query("metrics") == "true")
+			stats.ActiveSchedules = this.activeSchedules()
+			stats.Cache = this.domains.Stats()
+			running := util.PrintTimeDiff(stats.Started)
+			stats.Running = &running
 			stats.Domains = make([]*Domain, 0)
-			this.domains.Range(func(key, value interface{}) bool {
-				running := util.PrintTimeDiff(stats.Started)
-				stats.Running = &running
-				if key != nil && value != nil {
-					stats.Domains = append(stats.Domains, value.(*Domain))
-				}
+			for _, host := range this.state().hosts {
+				stats.Domains = append(stats.Domains, copyDomain(host))
+			}
+			this.domains.Range(func(key string, value interface{}, _ time.Time) bool {
+				stats.Domains = append(stats.Domains, copyDomain(value.(*Domain)))
 				return true
 			})
 			sort.SliceStable(stats.Domains, func(i, j int) bool {
@@ -70,8 +67,17 @@ func (this *Server) startRest(flush func() error) {
 			send(stats)
 		})
 
+		// Prometheus text format, the raw metrics are still at /metrics/recent or /?metrics=true
 		engine.GET("/metrics", func(ctx *gin.Context) {
-			ctx.JSON(http.StatusOK, this.stats.Metrics)
+			ctx.Header("Content-Type", prometheus.ContentType)
+			ctx.Status(http.StatusOK)
+			if err := this.exporter.registry.Write(ctx.Writer); err != nil {
+				this.log.Warnf("Could not write metrics: %s", err.Error())
+			}
+		})
+
+		engine.GET("/metrics/recent", func(ctx *gin.Context) {
+			ctx.JSON(http.StatusOK, this.stats.metrics.list())
 		})
 
 		engine.POST("/flush", func(ctx *gin.Context) {
@@ -83,10 +89,45 @@ func (this *Server) startRest(flush func() error) {
 			}
 		})
 
-		if err := engine.Run(":9999"); err != nil {
+		this.cacheRoutes(engine)
+		this.historyRoutes(engine)
+		this.reportRoutes(engine)
+		this.queryLogRoutes(engine)
+		this.streamRoutes(engine)
+		this.dashboardRoutes(engine)
+		this.adminRoutes(engine)
+
+		if err := this.serveHttp(engine); err != nil {
 			panic(err)
-		} else {
-			fmt.Printf("Successfully Started Server")
 		}
 	}()
 }
+
+// serveHttp serves the API on every listen address, with TLS if it is configured, until one of them fails
+func (this *Server) serveHttp(handler http.Handler) error {
+	listeners, err := this.listenHttp()
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if config := this.state().config; config.Http != nil && config.Http.Tls != nil {
+		certs, err := newCertificates(config.Http.Tls)
+		if err != nil {
+			return fmt.Errorf("could not load the TLS certificate: %s", err.Error())
+		}
+		go this.watchCertificates(certs)
+		tlsConfig = &tls.Config{GetConfigForClient: certs.tlsConfig}
+	}
+	server := &http.Server{Handler: handler}
+	failed := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		this.log.Infof("Serving the API on %s, TLS %t", listener.Addr().String(), tlsConfig != nil)
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		go func(listener net.Listener) {
+			failed <- server.Serve(listener)
+		}(listener)
+	}
+	return <-failed
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+const DefaultDnsListen = ":53"
+
+// Overrides are settings from the command line, which replace the ones in the config file
+type Overrides struct {
+	// ConfigFile is read instead of DefaultConfigFile
+	ConfigFile string
+	Udp        []string
+	Tcp        []string
+	Http       []string
+	// Ipv4Only and Ipv6Only leave out the other family on addresses without a host, and on interfaces
+	Ipv4Only bool
+	Ipv6Only bool
+}
+
+// listenAddress is one socket to open, the network is narrowed to udp4, tcp6 and so on when the family is known
+type listenAddress struct {
+	network string
+	address string
+}
+
+// listenConfig is the config's listen settings with the command line overrides applied
+func (this *Server) listenConfig() *ListenConfig {
+	listen := &ListenConfig{}
+	if config := this.state().config; config.Listen != nil {
+		copied := *config.Listen
+		listen = &copied
+	}
+	if this.overrides == nil {
+		return listen
+	}
+	if len(this.overrides.Udp) > 0 || len(this.overrides.Tcp) > 0 {
+		listen.Udp, listen.Tcp = this.overrides.Udp, this.overrides.Tcp
+	}
+	if this.overrides.Ipv4Only || this.overrides.Ipv6Only {
+		listen.DisableIpv4, listen.DisableIpv6 = this.overrides.Ipv6Only, this.overrides.Ipv4Only
+	}
+	return listen
+}
+
+// httpAddresses is where the HTTP API listens
+func (this *Server) httpAddresses() []string {
+	if this.overrides != nil && len(this.overrides.Http) > 0 {
+		return this.overrides.Http
+	}
+	if config := this.state().config; config.Http != nil && len(config.Http.Listen) > 0 {
+		return config.Http.Listen
+	}
+	return []string{DefaultHttpListen}
+}
+
+// ListenDns opens every DNS socket, using the ones passed in by systemd or launchd if there are any.
+// The servers are not started yet, see ServeDns
+func (this *Server) ListenDns() ([]*dns.Server, error) {
+	servers := make([]*dns.Server, 0)
+	if len(this.activated.dns) > 0 {
+		for _, socket := range this.activated.dns {
+			server, err := activatedDnsServer(socket)
+			if err != nil {
+				closeDnsServers(servers)
+				return nil, err
+			}
+			server.Handler = this
+			servers = append(servers, server)
+		}
+		return servers, nil
+	}
+	listen := this.listenConfig()
+	udp, tcp := listen.Udp, listen.Tcp
+	if len(udp) == 0 && len(tcp) == 0 {
+		udp = []string{DefaultDnsListen}
+	}
+	addresses := make([]listenAddress, 0)
+	for _, group := range []struct {
+		network   string
+		addresses []string
+	}{{"udp", udp}, {"tcp", tcp}} {
+		for _, address := range group.addresses {
+			expanded, err := expandAddress(group.network, address, !listen.DisableIpv4, !listen.DisableIpv6)
+			if err != nil {
+				return nil, err
+			}
+			addresses = append(addresses, expanded...)
+		}
+	}
+	for _, address := range addresses {
+		server := &dns.Server{Addr: address.address, Net: address.network, Handler: this}
+		var err error
+		if strings.HasPrefix(address.network, "udp") {
+			server.PacketConn, err = net.ListenPacket(address.network, address.address)
+		} else {
+			server.Listener, err = net.Listen(address.network, address.address)
+		}
+		if err != nil {
+			closeDnsServers(servers)
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// ServeDns answers queries on every server until one of them fails
+func (this *Server) ServeDns(servers []*dns.Server) error {
+	if len(servers) == 0 {
+		return errors.New("no DNS sockets to serve on")
+	}
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		if server.PacketConn != nil {
+			this.log.Infof("Serving DNS on %s/udp", server.PacketConn.LocalAddr().String())
+		} else {
+			this.log.Infof("Serving DNS on %s/tcp", server.Listener.Addr().String())
+		}
+		go func(server *dns.Server) {
+			failed <- server.ActivateAndServe()
+		}(server)
+	}
+	return <-failed
+}
+
+func closeDnsServers(servers []*dns.Server) {
+	for _, server := range servers {
+		if server.PacketConn != nil {
+			_ = server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			_ = server.Listener.Close()
+		}
+	}
+}
+
+// listenHttp opens the HTTP API's sockets, the activated ones if there are any
+func (this *Server) listenHttp() ([]net.Listener, error) {
+	if len(this.activated.http) > 0 {
+		listeners := make([]net.Listener, 0, len(this.activated.http))
+		for _, socket := range this.activated.http {
+			listener, err := net.FileListener(socket)
+			// The listener has its own copy of the socket
+			_ = socket.Close()
+			if err != nil {
+				return nil, fmt.Errorf("activated socket %s is not a TCP listener: %s", socket.Name(), err.Error())
+			}
+			listeners = append(listeners, listener)
+		}
+		return listeners, nil
+	}
+	listen := this.listenConfig()
+	listeners := make([]net.Listener, 0)
+	for _, address := range this.httpAddresses() {
+		expanded, err := expandAddress("tcp", address, !listen.DisableIpv4, !listen.DisableIpv6)
+		if err != nil {
+			return nil, err
+		}
+		for _, each := range expanded {
+			listener, err := net.Listen(each.network, each.address)
+			if err != nil {
+				for _, opened := range listeners {
+					_ = opened.Close()
+				}
+				return nil, err
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners, nil
+}
+
+// expandAddress works out the sockets for an address. An IPv4 or IPv6 host only listens on that family,
+// no host listens on every address of the enabled families, and an interface name on each of its addresses
+func expandAddress(network string, address string, ipv4 bool, ipv6 bool) ([]listenAddress, error) {
+	if !ipv4 && !ipv6 {
+		return nil, errors.New("both IPv4 and IPv6 are disabled")
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %s", address, err.Error())
+	}
+	if host == "" {
+		switch {
+		case ipv4 && ipv6:
+			return []listenAddress{{network, address}}, nil
+		case ipv4:
+			return []listenAddress{{network + "4", net.JoinHostPort("0.0.0.0", port)}}, nil
+		default:
+			return []listenAddress{{network + "6", net.JoinHostPort("::", port)}}, nil
+		}
+	}
+	if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip != nil {
+		if ip.To4() != nil {
+			return []listenAddress{{network + "4", address}}, nil
+		}
+		return []listenAddress{{network + "6", address}}, nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		// A host name, which is looked up when the socket is opened
+		return []listenAddress{{network, address}}, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the addresses of %s: %s", host, err.Error())
+	}
+	expanded := make([]listenAddress, 0)
+	for _, addr := range addrs {
+		subnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if subnet.IP.To4() != nil && ipv4 {
+			expanded = append(expanded, listenAddress{network + "4", net.JoinHostPort(subnet.IP.String(), port)})
+		} else if subnet.IP.To4() == nil && ipv6 {
+			ip := subnet.IP.String()
+			if subnet.IP.IsLinkLocalUnicast() {
+				// Link local addresses are only unique with their interface
+				ip += "%" + iface.Name
+			}
+			expanded = append(expanded, listenAddress{network + "6", net.JoinHostPort(ip, port)})
+		}
+	}
+	if len(expanded) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses to listen on", host)
+	}
+	return expanded, nil
+}
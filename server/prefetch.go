@@ -0,0 +1,43 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// prefetch refreshes a popular answer in the background once it is close to expiring
+func (this *Server) prefetch(policy *Policy, domain *Domain) {
+	config := this.state().config.Prefetch
+	if config == nil || !config.Enabled || domain.Ttl == 0 {
+		return
+	}
+	percent := DefaultPrefetchPercent
+	if config.Percent > 0 {
+		percent = config.Percent
+	}
+	minRequests := int64(DefaultPrefetchMinRequests)
+	if config.MinRequests > 0 {
+		minRequests = config.MinRequests
+	}
+	if atomic.LoadInt64(&domain.Requests) < minRequests {
+		return
+	}
+	ttl := time.Duration(domain.Ttl) * time.Second
+	remaining := time.Until(time.Unix(0, domain.Time).Add(ttl))
+	if remaining > ttl*time.Duration(percent)/100 {
+		return
+	}
+	key := policy.cacheKey(domain.Name)
+	if _, inFlight := this.prefetching.LoadOrStore(key, true); inFlight {
+		return
+	}
+	atomic.AddInt64(&this.stats.PrefetchRequests, 1)
+	go func() {
+		defer this.prefetching.Delete(key)
+		if _, err := this.fetch(policy, domain.Name); err != nil {
+			this.logFor(nil, domain.Name).Warnf("Could not prefetch %s: %s", domain.Name, err.Error())
+		} else {
+			this.logFor(nil, domain.Name).Debugf("Prefetched %s with %s left", domain.Name, remaining.Round(time.Second))
+		}
+	}()
+}
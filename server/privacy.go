@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/kamackay/dns/wildcard"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// hiddenLog drops the lines about queries that are not logged
+var hiddenLog = &logrus.Logger{
+	Out:       ioutil.Discard,
+	Formatter: new(logrus.TextFormatter),
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.PanicLevel,
+}
+
+const (
+	DefaultSaltRotation = 24 * time.Hour
+	// hashLength is how many hex characters of a client hash are kept
+	hashLength = 16
+)
+
+// privacy decides what the query log and the reports may record about a query.
+// The counters are never affected, but the recent metrics, top domains and failed domains leave hidden names out
+type privacy struct {
+	disabled      bool
+	ipv4Mask      net.IPMask
+	ipv6Mask      net.IPMask
+	hash          bool
+	rotation      time.Duration
+	ignoreClients []*net.IPNet
+	ignoreDomains []string
+
+	mutex  sync.Mutex
+	salt   []byte
+	salted time.Time
+}
+
+// newPrivacy builds the privacy settings, keeping the salt of the previous settings so hashes survive a reload
+func (this *Server) newPrivacy(config *PrivacyConfig, previous *privacy) *privacy {
+	settings := &privacy{
+		ignoreClients: make([]*net.IPNet, 0),
+		ignoreDomains: make([]string, 0),
+		rotation:      DefaultSaltRotation,
+	}
+	if config == nil {
+		return settings
+	}
+	settings.disabled = config.DisableLogging
+	settings.hash = config.HashClients
+	if config.Ipv4Prefix > 0 && config.Ipv4Prefix < 32 {
+		settings.ipv4Mask = net.CIDRMask(config.Ipv4Prefix, 32)
+	}
+	if config.Ipv6Prefix > 0 && config.Ipv6Prefix < 128 {
+		settings.ipv6Mask = net.CIDRMask(config.Ipv6Prefix, 128)
+	}
+	if config.SaltRotationHours > 0 {
+		settings.rotation = time.Duration(config.SaltRotationHours) * time.Hour
+	}
+	for _, client := range config.IgnoreClients {
+		if subnet := parseSubnet(client); subnet != nil {
+			settings.ignoreClients = append(settings.ignoreClients, subnet)
+		} else {
+			this.log.Warnf("Invalid IP %s in ignored clients", client)
+		}
+	}
+	for _, domain := range config.IgnoreDomains {
+		settings.ignoreDomains = append(settings.ignoreDomains, normalizeName(domain))
+	}
+	if previous != nil {
+		previous.mutex.Lock()
+		settings.salt, settings.salted = previous.salt, previous.salted
+		previous.mutex.Unlock()
+	}
+	return settings
+}
+
+// logged reports whether the query may be written to the query log and the reports
+func (this *privacy) logged(client *Client, domainName string) bool {
+	if client == nil || !this.shows(domainName) {
+		return false
+	}
+	for _, subnet := range this.ignoreClients {
+		if client.Ip != nil && subnet.Contains(client.Ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// shows reports whether the domain may be logged, for lookups not made for one client like a cache refresh
+func (this *privacy) shows(domainName string) bool {
+	if this.disabled {
+		return false
+	}
+	for _, pattern := range this.ignoreDomains {
+		if wildcard.Match(pattern, domainName) {
+			return false
+		}
+	}
+	return true
+}
+
+// hides reports whether the domain must be left out of anything recording it.
+// client is nil for lookups not made for a query, then only the domain is checked
+func (this *privacy) hides(client *Client, domainName string) bool {
+	if client == nil {
+		return !this.shows(domainName)
+	}
+	return !this.logged(client, domainName)
+}
+
+// logFor is where lines naming the domain are logged, nowhere if privacy keeps the query out of the query log
+func (this *Server) logFor(client *Client, domainName string) *logrus.Logger {
+	if this.state().privacy.hides(client, domainName) {
+		return hiddenLog
+	}
+	return this.log
+}
+
+// label is how the client is recorded, empty when the query is not logged
+func (this *privacy) label(client *Client, domainName string) string {
+	if !this.logged(client, domainName) {
+		return ""
+	}
+	return this.anonymize(client.Ip)
+}
+
+// anonymize truncates the address to the configured prefix, then hashes it if configured
+func (this *privacy) anonymize(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// An IPv4 address may come in 4 or 16 bytes, which would hash differently
+		ip = ip4
+		if this.ipv4Mask != nil {
+			ip = ip.Mask(this.ipv4Mask)
+		}
+	} else if this.ipv6Mask != nil {
+		ip = ip.Mask(this.ipv6Mask)
+	}
+	if !this.hash {
+		return ip.String()
+	}
+	salt, err := this.currentSalt()
+	if err != nil {
+		// Without a salt the hash could be reversed, so the address is left out instead
+		return ""
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ip)
+	return hex.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// currentSalt returns the salt, replacing it once it is older than the rotation,
+// after which the same client hashes to something new
+func (this *privacy) currentSalt() ([]byte, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.salt == nil || time.Since(this.salted) >= this.rotation {
+		salt := make([]byte, sha256.Size)
+		// Without randomness a fixed salt would make hashes reversible by brute force
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		this.salt = salt
+		this.salted = time.Now()
+	}
+	return this.salt, nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/querylog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// MaxQueryLogPage is larger than the cache pages, since query log results are streamed
+	MaxQueryLogPage = 10_000
+	// QueryLogFlushEvery is how many results are written between flushes to the client
+	QueryLogFlushEvery = 100
+)
+
+// openQueryLog starts the query log writer, nil if it is disabled or cannot be opened
+func (this *Server) openQueryLog() *querylog.Writer {
+	current := this.state()
+	config := current.config.QueryLog
+	if config == nil || !config.Enabled || current.privacy.disabled {
+		return nil
+	}
+	options := querylog.Options{
+		File:      config.File,
+		MaxBytes:  int64(config.MaxSizeMb) * 1024 * 1024,
+		MaxAge:    time.Duration(config.MaxAgeHours) * time.Hour,
+		MaxFiles:  config.MaxFiles,
+		Retention: time.Duration(config.RetentionDays) * 24 * time.Hour,
+		Compress:  config.Compress,
+		Buffer:    config.BufferSize,
+	}
+	if options.File == "" {
+		options.File = DefaultQueryLogFile
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = querylog.DefaultMaxBytes
+	}
+	writer, err := querylog.Open(options)
+	if err != nil {
+		this.log.Errorf("Could not open the query log %s: %s", options.File, err.Error())
+		return nil
+	}
+	this.log.Infof("Logging Queries to %s", options.File)
+	return writer
+}
+
+// recordQuery counts a finished query everywhere it is tracked, as far as the privacy settings allow.
+// client and answer are nil when the query failed before they were known
+func (this *Server) recordQuery(question dns.Question, client *Client, answer *Domain, rcode int, result string, start int64) {
+	now := time.Now()
+	took := now.UnixNano() - start
+	atomic.AddInt64(&this.stats.TotalRequests, 1)
+	this.exporter.observeAnswer(question.Qtype, rcode, result, took)
+	privacy := this.state().privacy
+	if privacy.hides(client, question.Name) {
+		// Still counted, just not among the top domains
+		this.history.record(result, "", now)
+		return
+	}
+	this.history.record(result, question.Name, now)
+	if client == nil {
+		return
+	}
+	address := privacy.anonymize(client.Ip)
+	this.reports.record(address, client.Policy.Name, question.Name, result, now)
+	if this.queryLog == nil && !this.stream.active() {
+		return
+	}
+	entry := &querylog.Entry{
+		Time:    now.UnixNano() / NanoConv,
+		Name:    question.Name,
+		Type:    typeName(question.Qtype),
+		Rcode:   dns.RcodeToString[rcode],
+		Latency: took / int64(time.Microsecond),
+		Result:  result,
+	}
+	entry.Client = address
+	entry.Group = client.Policy.Name
+	if answer != nil && result != ResultBlocked && result != ResultFailed {
+		entry.Answer = answer.Ip
+		entry.Cname = answer.Cname
+		if result == ResultForwarded {
+			entry.Upstream = answer.Server
+		}
+	}
+	this.stream.publish(entry)
+	if this.queryLog != nil && !this.queryLog.Write(entry) {
+		this.log.Debugf("Query log is full, dropped %s", question.Name)
+	}
+}
+
+func typeName(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+// queryLogTrailer follows the streamed entries in a search result
+type queryLogTrailer struct {
+	Next  string `json:"next"`
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+func (this *Server) queryLogRoutes(engine *gin.Engine) {
+	// Search the query log, oldest first. Results are written as they are found,
+	// and next is a cursor for the following page, empty once there are no more matches
+	engine.GET("/querylog", func(ctx *gin.Context) {
+		if this.queryLog == nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "query log is disabled"})
+			return
+		}
+		query, limit, err := parseLogQuery(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Header("Content-Type", "application/json; charset=utf-8")
+		ctx.Status(http.StatusOK)
+		_, _ = ctx.Writer.WriteString(`{"entries":[`)
+		count := 0
+		next, err := querylog.Search(this.queryLog.File(), query, limit, func(entry *querylog.Entry) bool {
+			line, err := jsoniter.Marshal(entry)
+			if err != nil {
+				return true
+			}
+			if count > 0 {
+				_, _ = ctx.Writer.WriteString(",")
+			}
+			count++
+			if _, err = ctx.Writer.Write(line); err != nil {
+				// The client went away
+				return false
+			}
+			if count%QueryLogFlushEvery == 0 {
+				ctx.Writer.Flush()
+			}
+			return true
+		})
+		// The status is already sent, so an error can only be reported after the entries
+		trailer := &queryLogTrailer{Next: next, Count: count}
+		if err != nil {
+			this.log.Warnf("Could not search the query log: %s", err.Error())
+			trailer.Error = err.Error()
+		}
+		data, _ := jsoniter.Marshal(trailer)
+		// Close the entries array and continue the object with the trailer's fields
+		_, _ = ctx.Writer.WriteString("]," + string(data[1:]))
+	})
+}
+
+func parseLogQuery(ctx *gin.Context) (querylog.Query, int, error) {
+	query := querylog.Query{
+		Client: ctx.Query("client"),
+		Domain: ctx.Query("domain"),
+		Type:   ctx.Query("type"),
+		Rcode:  ctx.Query("rcode"),
+		Result: ctx.Query("result"),
+		Cursor: ctx.Query("cursor"),
+	}
+	if value := ctx.Query("from"); value != "" {
+		from, err := parseTimeParam(value, time.Time{})
+		if err != nil {
+			return query, 0, errors.New("invalid from: " + err.Error())
+		}
+		query.From = from.UnixNano() / NanoConv
+	}
+	if value := ctx.Query("to"); value != "" {
+		to, err := parseTimeParam(value, time.Time{})
+		if err != nil {
+			return query, 0, errors.New("invalid to: " + err.Error())
+		}
+		query.To = to.UnixNano() / NanoConv
+	}
+	if value := ctx.Query("blocked"); value != "" {
+		blocked, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, 0, errors.New("invalid blocked: " + value)
+		}
+		query.Blocked = &blocked
+	}
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(DefaultPageSize)))
+	if err != nil || limit <= 0 || limit > MaxQueryLogPage {
+		return query, 0, errors.New("limit must be between 1 and " + strconv.Itoa(MaxQueryLogPage))
+	}
+	return query, limit, nil
+}
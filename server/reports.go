@@ -0,0 +1,215 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTopLimit = 10
+	MaxTopLimit     = 1000
+	// MaxTrackedClients bounds the per client stats, the least active clients are dropped past it
+	MaxTrackedClients = 1000
+	// MaxTrackedDomains bounds each top domain count, see historyDomainSlack
+	MaxTrackedDomains = 1000
+)
+
+// ClientReport is what a client has asked since the server started
+type ClientReport struct {
+	// Client is the address, truncated or hashed if the privacy settings say so
+	Client string `json:"client"`
+	// Name is the local host entry pointing at the client, if there is one
+	Name     string `json:"name,omitempty"`
+	Group    string `json:"group"`
+	Queries  int64  `json:"queries"`
+	Blocked  int64  `json:"blocked"`
+	Failed   int64  `json:"failed"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  int64  `json:"count"`
+}
+
+// reports counts queries per client and the most blocked and failing domains
+type reports struct {
+	mutex   sync.Mutex
+	clients map[string]*clientCounts
+	blocked map[string]int64
+	failed  map[string]int64
+}
+
+type clientCounts struct {
+	report  ClientReport
+	domains map[string]int64
+}
+
+func newReports() *reports {
+	return &reports{
+		clients: make(map[string]*clientCounts),
+		blocked: make(map[string]int64),
+		failed:  make(map[string]int64),
+	}
+}
+
+// record counts one answered query, result is one of the Result constants
+func (this *reports) record(address string, group string, domainName string, result string, now time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	counts, ok := this.clients[address]
+	if !ok {
+		if len(this.clients) >= MaxTrackedClients {
+			this.dropQuietestClient()
+		}
+		counts = &clientCounts{
+			report:  ClientReport{Client: address},
+			domains: make(map[string]int64),
+		}
+		this.clients[address] = counts
+	}
+	counts.report.Group = group
+	counts.report.Queries++
+	counts.report.LastSeen = now.UnixNano() / NanoConv
+	addCount(counts.domains, domainName)
+	switch result {
+	case ResultBlocked:
+		counts.report.Blocked++
+		addCount(this.blocked, domainName)
+	case ResultFailed:
+		counts.report.Failed++
+		addCount(this.failed, domainName)
+	}
+}
+
+func (this *reports) dropQuietestClient() {
+	quietest := ""
+	for address, counts := range this.clients {
+		if quietest == "" || counts.report.Queries < this.clients[quietest].report.Queries {
+			quietest = address
+		}
+	}
+	delete(this.clients, quietest)
+}
+
+// addCount counts a domain, trimming the map once it grows well past what is reported
+func addCount(counts map[string]int64, domainName string) {
+	counts[domainName]++
+	if len(counts) > MaxTrackedDomains*historyDomainSlack {
+		trimDomains(counts, MaxTrackedDomains)
+	}
+}
+
+func topDomains(counts map[string]int64, limit int) []*DomainCount {
+	names := sortByCount(counts)
+	if len(names) > limit {
+		names = names[:limit]
+	}
+	top := make([]*DomainCount, len(names))
+	for i, name := range names {
+		top[i] = &DomainCount{Domain: name, Count: counts[name]}
+	}
+	return top
+}
+
+func (this *reports) topClients(limit int) []*ClientReport {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	queries := make(map[string]int64, len(this.clients))
+	for address, counts := range this.clients {
+		queries[address] = counts.report.Queries
+	}
+	top := make([]*ClientReport, 0, limit)
+	for _, address := range sortByCount(queries) {
+		if len(top) == limit {
+			break
+		}
+		report := this.clients[address].report
+		top = append(top, &report)
+	}
+	return top
+}
+
+func (this *reports) topClientDomains(address string, limit int) ([]*DomainCount, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	counts, ok := this.clients[address]
+	if !ok {
+		return nil, false
+	}
+	return topDomains(counts.domains, limit), true
+}
+
+func (this *reports) topBlocked(limit int) []*DomainCount {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return topDomains(this.blocked, limit)
+}
+
+func (this *reports) topFailed(limit int) []*DomainCount {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return topDomains(this.failed, limit)
+}
+
+// hostNames maps addresses to the local host entries pointing at them, like a reverse lookup
+func (this *Server) hostNames() map[string]string {
+	names := make(map[string]string)
+	for name, host := range this.state().hosts {
+		if host == nil || host.Cname != "" || net.ParseIP(host.Ip) == nil || strings.Contains(name, "*") {
+			continue
+		}
+		if existing, ok := names[host.Ip]; !ok || name < existing {
+			names[host.Ip] = name
+		}
+	}
+	for ip, name := range names {
+		names[ip] = strings.TrimSuffix(name, ".")
+	}
+	return names
+}
+
+func (this *Server) reportRoutes(engine *gin.Engine) {
+	engine.GET("/top/clients", func(ctx *gin.Context) {
+		clients := this.reports.topClients(topLimit(ctx))
+		names := this.hostNames()
+		for _, client := range clients {
+			client.Name = names[client.Client]
+		}
+		ctx.JSON(http.StatusOK, clients)
+	})
+
+	engine.GET("/top/clients/:client/domains", func(ctx *gin.Context) {
+		address := ctx.Param("client")
+		if ip := net.ParseIP(address); ip != nil {
+			address = ip.String()
+		}
+		domains, ok := this.reports.topClientDomains(address, topLimit(ctx))
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "unknown client", "client": address})
+			return
+		}
+		ctx.JSON(http.StatusOK, domains)
+	})
+
+	engine.GET("/top/blocked", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, this.reports.topBlocked(topLimit(ctx)))
+	})
+
+	engine.GET("/top/failed", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, this.reports.topFailed(topLimit(ctx)))
+	})
+}
+
+func topLimit(ctx *gin.Context) int {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(DefaultTopLimit)))
+	if err != nil || limit <= 0 || limit > MaxTopLimit {
+		return DefaultTopLimit
+	}
+	return limit
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"strings"
+)
+
+const (
+	GoogleSafeSearch     = "forcesafesearch.google.com."
+	BingSafeSearch       = "strict.bing.com."
+	DuckDuckGoSafeSearch = "safe.duckduckgo.com."
+	YoutubeRestricted    = "restrict.youtube.com."
+)
+
+// safeSearchHosts maps search engine names to the CNAME target that enforces safe search
+var safeSearchHosts = map[string]string{
+	"www.bing.com.":             BingSafeSearch,
+	"bing.com.":                 BingSafeSearch,
+	"duckduckgo.com.":           DuckDuckGoSafeSearch,
+	"www.duckduckgo.com.":       DuckDuckGoSafeSearch,
+	"start.duckduckgo.com.":     DuckDuckGoSafeSearch,
+	"www.youtube.com.":          YoutubeRestricted,
+	"m.youtube.com.":            YoutubeRestricted,
+	"youtubei.googleapis.com.":  YoutubeRestricted,
+	"youtube.googleapis.com.":   YoutubeRestricted,
+	"www.youtube-nocookie.com.": YoutubeRestricted,
+}
+
+// safeSearchTarget returns the CNAME target to answer with when the policy enforces safe search
+func safeSearchTarget(policy *Policy, domainName string) (string, bool) {
+	if !policy.safeSearch {
+		return "", false
+	}
+	name := strings.ToLower(domainName)
+	if target, ok := safeSearchHosts[name]; ok {
+		return target, true
+	}
+	if isGoogleSearch(name) {
+		return GoogleSafeSearch, true
+	}
+	return "", false
+}
+
+// isGoogleSearch matches google.com and the country domains like www.google.co.uk
+func isGoogleSearch(name string) bool {
+	name = strings.TrimPrefix(name, "www.")
+	if !strings.HasPrefix(name, "google.") {
+		return false
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")[1:]
+	switch len(labels) {
+	case 1:
+		return len(labels[0]) >= 2
+	case 2:
+		// google.co.uk, google.com.au
+		return (labels[0] == "co" || labels[0] == "com") && len(labels[1]) == 2
+	}
+	return false
+}
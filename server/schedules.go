@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/kamackay/dns/filter"
+	"sort"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// schedule is the compiled form of a Schedule
+type schedule struct {
+	name     string
+	days     map[time.Weekday]bool
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+// scheduledBlock is the compiled form of a ScheduledBlock
+type scheduledBlock struct {
+	schedule *schedule
+	blocks   map[string]bool
+	filters  *filter.List
+}
+
+func parseSchedule(name string, config *Schedule) (*schedule, error) {
+	result := &schedule{
+		name:     name,
+		days:     make(map[time.Weekday]bool),
+		location: time.Local,
+	}
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		result.location = location
+	}
+	for _, day := range config.Days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		weekday, ok := weekdays[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+		result.days[weekday] = true
+	}
+	if len(result.days) == 0 {
+		for _, weekday := range weekdays {
+			result.days[weekday] = true
+		}
+	}
+	var err error
+	if result.start, err = parseTimeOfDay(config.Start, 0); err != nil {
+		return nil, err
+	}
+	if result.end, err = parseTimeOfDay(config.End, 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if result.start == result.end {
+		return nil, errors.New("schedule start and end are the same")
+	}
+	return result, nil
+}
+
+// parseTimeOfDay reads "HH:MM" as an offset from midnight
+func parseTimeOfDay(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if value == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// active reports whether the schedule covers the given time.
+// Ranges that end before they start run past midnight, and belong to the day they start on
+func (this *schedule) active(now time.Time) bool {
+	if this == nil {
+		return true
+	}
+	local := now.In(this.location)
+	offset := time.Duration(local.Hour())*time.Hour +
+		time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second
+	today := local.Weekday()
+	if this.start < this.end {
+		return this.days[today] && offset >= this.start && offset < this.end
+	}
+	yesterday := (today + 6) % 7
+	return (this.days[today] && offset >= this.start) ||
+		(this.days[yesterday] && offset < this.end)
+}
+
+func (this *Server) buildSchedules(config *Config) map[string]*schedule {
+	schedules := make(map[string]*schedule)
+	for name, definition := range config.Schedules {
+		if definition == nil {
+			continue
+		}
+		compiled, err := parseSchedule(name, definition)
+		if err != nil {
+			this.log.Warnf("Invalid Schedule %s: %s", name, err.Error())
+			continue
+		}
+		schedules[name] = compiled
+	}
+	return schedules
+}
+
+func (this *Server) buildScheduledBlocks(schedules map[string]*schedule, definitions []*ScheduledBlock) []*scheduledBlock {
+	blocks := make([]*scheduledBlock, 0)
+	for _, definition := range definitions {
+		if definition == nil {
+			continue
+		}
+		compiled, ok := schedules[definition.Schedule]
+		if !ok {
+			this.log.Warnf("Unknown Schedule %s", definition.Schedule)
+			continue
+		}
+		blocks = append(blocks, &scheduledBlock{
+			schedule: compiled,
+			blocks:   definition.Blocks,
+			filters:  this.loadFilters(definition.Rules, nil),
+		})
+	}
+	return blocks
+}
+
+// checkScheduledBlock returns the name of the active schedule blocking the domain, if any
+func (this *Server) checkScheduledBlock(policy *Policy, domainName string, qtype uint16, client *Client) (string, bool) {
+	now := time.Now()
+	for _, block := range policy.scheduled {
+		if !block.schedule.active(now) {
+			continue
+		}
+		if this.checkBlock(block.blocks, domainName) {
+			return block.schedule.name, true
+		}
+		if rule := block.filters.Match(domainName, qtype, client.filterClient()); rule != nil && !rule.Exception {
+			return block.schedule.name, true
+		}
+	}
+	return "", false
+}
+
+func (this *Server) activeSchedules() []string {
+	active := make([]string, 0)
+	now := time.Now()
+	for name, compiled := range this.state().schedules {
+		if compiled.active(now) {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
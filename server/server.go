@@ -1,83 +1,135 @@
 package server
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/cache"
 	"gitlab.com/kamackay/dns/dns_resolver"
 	"gitlab.com/kamackay/dns/logging"
 	"gitlab.com/kamackay/dns/util"
-	"math"
 	"net"
-	"strconv"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func (this *Server) lookupInMap(domainName string) (*Domain, int8) {
-	domainInterface, ok := lookupInMapAndUpdate(convertMutexToMap(&this.domains),
-		domainName,
-		func(domain *Domain) {
-			domain.Requests++
-		})
-	var domain *Domain
-	var result int8
-	this.log.Debugf("Using: %+v, %t", domain, ok)
-	if ok {
-		domain = domainInterface.(*Domain)
-		result = getResultFromDomain(domain)
-		if time.Now().UnixNano()/NanoConv-domain.Time/NanoConv <= int64(domain.Ttl)*1000 {
-			return domain, result
+// lookupLocal checks the local hosts, the pulled block list unless the name is allowed, and then the answer cache
+func (this *Server) lookupLocal(policy *Policy, domainName string, allowed bool, trace *Trace) (*Domain, int8) {
+	current := this.state()
+	if host, ok := lookupInMapAndUpdate(current.hosts, domainName, func(domain *Domain) {
+		atomic.AddInt64(&domain.Requests, 1)
+	}); ok {
+		atomic.AddInt64(&this.stats.CachedRequests, 1)
+		domain := host.(*Domain)
+		if domain.Cname != "" {
+			trace.note("hosts", false, "%s is a CNAME for %s", domainName, domain.Cname)
+		} else {
+			trace.note("hosts", true, "answered by hosts with %s", domain.Ip)
 		}
-	} else {
-		result = NotFound
+		return domain, Ok
 	}
-
-	if domain != nil && domain.Block {
-		// If the domain is blocked, add it to the map so that the next lookup is faster
-		this.store(&Domain{
-			Name:     domainName,
-			Time:     time.Now().UnixNano(),
-			Ip:       BlockedIp,
-			Block:    true,
-			Requests: 1,
-			Ttl:      math.MaxUint32,
-		})
+	rule := current.blockList.Match(domainName, 0, nil)
+	switch {
+	case current.blockList == nil:
+		trace.note("block list", false, "not pulled")
+	case rule != nil && allowed:
+		// An exception rule overrides the pulled block list
+		trace.note("block list", false, "matches %s, but the name is allowed", rule.Text)
+	case rule != nil:
+		trace.note("block list", true, "blocked by %s", rule.Text)
+		return getBlockedDomainObj(domainName), Block
+	default:
+		trace.note("block list", false, "none of the %d entries match", current.blockList.Len())
 	}
+	value, ok := this.domains.Get(policy.cacheKey(domainName))
+	if !ok {
+		return getFailedDomainObj(domainName), NotFound
+	}
+	domain := value.(*Domain)
+	atomic.AddInt64(&domain.Requests, 1)
+	atomic.AddInt64(&this.stats.CachedRequests, 1)
+	this.prefetch(policy, domain)
+	trace.note("cache", true, "answered from the cache with %s", domain.Ip)
+	return domain, Ok
+}
 
-	if domain == nil {
-		return getFailedDomainObj(domainName), result
+// store adds an upstream answer to the cache, scoped to the policy's upstreams.
+// The request count of the answer being replaced carries over, so popularity survives a refresh
+func (this *Server) store(policy *Policy, domain *Domain) {
+	key := policy.cacheKey(domain.Name)
+	if old, _, ok := this.domains.Peek(key); ok && old.(*Domain) != domain {
+		domain.Requests += atomic.LoadInt64(&old.(*Domain).Requests)
 	}
-	this.stats.CachedRequests++
-	return domain, result
+	expires := time.Unix(0, domain.Time).Add(time.Duration(domain.Ttl) * time.Second)
+	this.domains.Set(key, domain, getDomainSize(domain), expires)
 }
 
-func (this *Server) store(domain *Domain) {
-	oldDomainInterface, ok := this.domains.Load(domain.Name)
-	if ok {
-		// Domain was already in map, update
-		oldDomain := oldDomainInterface.(*Domain)
-		oldDomain.Requests++
-		this.domains.Store(domain.Name, oldDomain)
+// getIp answers the domain for the client, along with how it was answered, one of the Result constants.
+// Each check is noted in the trace, which is nil unless the answer is being explained
+func (this *Server) getIp(domainName string, qtype uint16, client *Client, trace *Trace) (*Domain, string, error) {
+	policy := client.Policy
+	rule := policy.filters.Match(domainName, qtype, client.filterClient())
+	allowed := rule != nil && rule.Exception
+	switch {
+	case rule == nil:
+		trace.note("rules", false, "none of the %d rules match", policy.filters.Len())
+	case allowed:
+		trace.note("rules", false, "allowed by %s, which skips the blocks, services and block list", describeRule(rule))
+	default:
+		this.logFor(client, domainName).Warnf("Blocking %s by rule %s", domainName, rule.Text)
+		trace.note("rules", true, "blocked by %s", describeRule(rule))
+		atomic.AddInt64(&this.stats.BlockedRequests, 1)
+		return getBlockedDomainObj(domainName), ResultBlocked, errors.New("blocked " + domainName)
+	}
+	if !allowed && this.checkBlock(policy.blocks, domainName) {
+		trace.note("blocks", true, "blocked by an entry in blocks")
+		atomic.AddInt64(&this.stats.BlockedRequests, 1)
+		return getBlockedDomainObj(domainName), ResultBlocked, errors.New("blocked " + domainName)
+	} else if !allowed {
+		trace.note("blocks", false, "not listed")
+	}
+	if name, blocked := this.checkServiceBlock(policy, domainName, qtype, client); blocked && !allowed {
+		this.logFor(client, domainName).Warnf("Blocking %s as part of %s", domainName, name)
+		trace.note("services", true, "blocked as part of %s", name)
+		atomic.AddInt64(&this.stats.BlockedRequests, 1)
+		return getBlockedDomainObj(domainName), ResultBlocked, errors.New("blocked " + domainName)
+	} else if blocked {
+		trace.note("services", false, "part of %s, but the name is allowed", name)
 	} else {
-		// Domain was not in map, add
-		this.domains.Store(domain.Name, domain)
+		trace.note("services", false, "not part of any of the %d blocked services", len(policy.services))
+	}
+	if name, blocked := this.checkScheduledBlock(policy, domainName, qtype, client); blocked {
+		this.logFor(client, domainName).Warnf("Blocking %s on schedule %s", domainName, name)
+		trace.note("schedules", true, "blocked on schedule %s", name)
+		atomic.AddInt64(&this.stats.BlockedRequests, 1)
+		return getBlockedDomainObj(domainName), ResultBlocked, errors.New("blocked " + domainName)
+	} else if trace != nil {
+		trace.note("schedules", false, "no block applies, active schedules are %s", describeList(this.activeSchedules()))
 	}
+	if target, ok := safeSearchTarget(policy, domainName); ok {
+		trace.note("safe search", false, "rewritten to %s", target)
+		return this.resolveCname(client, domainName, target, allowed, 0, trace)
+	}
+	return this.resolve(client, domainName, allowed, 0, trace)
 }
 
-func (this *Server) getIp(domainName string) (*Domain, error) {
-	if this.checkBlock(domainName) {
-		return getBlockedDomainObj(domainName), errors.New("blocked " + domainName)
-	}
-	address, result := this.lookupInMap(domainName)
-	if result == Ok {
-		return address, nil
+// resolve answers from local hosts, the cache or the upstream servers, in that order
+func (this *Server) resolve(client *Client, domainName string, allowed bool, depth int, trace *Trace) (*Domain, string, error) {
+	policy := client.Policy
+	address, result := this.lookupLocal(policy, domainName, allowed, trace)
+	if result == Ok && address.Cname != "" {
+		return this.resolveCname(client, domainName, address.Cname, allowed, depth, trace)
+	} else if result == Ok {
+		return address, ResultCached, nil
 	} else if result == Block {
-		this.log.Warnf("Blocking %s", domainName)
-		this.stats.BlockedRequests++
-		this.addMetric(Metric{
+		this.logFor(client, domainName).Warnf("Blocking %s", domainName)
+		atomic.AddInt64(&this.stats.BlockedRequests, 1)
+		this.addMetric(client, Metric{
 			MetricType: "Block",
 			Time:       time.Now().UnixNano() / NanoConv,
 			Ip:         BlockedIp,
@@ -85,49 +137,110 @@ func (this *Server) getIp(domainName string) (*Domain, error) {
 			Blocked:    false,
 			Domain:     domainName,
 		})
-		return getBlockedDomainObj(domainName), errors.New("blocked " + domainName)
+		return getBlockedDomainObj(domainName), ResultBlocked, errors.New("blocked " + domainName)
+	} else if trace != nil && trace.local {
+		trace.note("upstream", false, "not a local name, so the upstream servers would be asked")
+		return getFailedDomainObj(domainName), "", errNotAsked
 	} else {
-		if result, err := this.resolver.LookupHost(strings.TrimRight(domainName, "."));
-			err != nil || len(result.Ips) == 0 {
-			this.stats.FailedRequests++
-			this.stats.FailedDomains = unique(append(this.stats.FailedDomains, domainName))
-			this.log.Error(err)
-			return getFailedDomainObj(domainName), err
-		} else {
-			answer := result.Ips[0]
-			this.log.Infof("Fetched \"%s\" = %s from %s",
-				domainName, answer.Address, result.Server)
-			domain := &Domain{
-				Ip:       answer.Address,
-				Ttl:      answer.Ttl,
-				Name:     domainName,
-				Time:     time.Now().UnixNano(),
-				Block:    false,
-				Requests: 1,
-				Server:   result.Server,
+		domain, err := this.fetch(policy, domainName)
+		if err != nil {
+			if stale, ok := this.serveStale(policy, domainName, err); ok {
+				trace.note("upstream", true, "unreachable, so a stale answer was served: %s", err.Error())
+				return stale, ResultStale, nil
 			}
-			go func() {
-				// Add to cache
-				this.store(domain)
-				this.stats.LookupRequests++
-				this.addMetric(Metric{
-					MetricType: "Fetch",
-					Time:       0,
-					Ip:         answer.Address,
-					Server:     result.Server,
-					Blocked:    false,
-					Domain:     domainName,
-				})
-				//this.printAllHosts()
-			}()
-			return domain, nil
+			this.addFailed(client, domainName)
+			this.logFor(client, domainName).Error(err)
+			trace.note("upstream", true, "failed: %s", err.Error())
+			return getFailedDomainObj(domainName), ResultFailed, err
 		}
+		trace.note("upstream", true, "answered by %s with %s", domain.Server, domain.Ip)
+		return domain, ResultForwarded, nil
+	}
+}
+
+// fetch looks the domain up with the policy's upstreams and caches the answer.
+// Concurrent fetches of the same name share one upstream query
+func (this *Server) fetch(policy *Policy, domainName string) (*Domain, error) {
+	// Only A records are looked up upstream for now, so the type is fixed in the key
+	key := policy.cacheKey(domainName) + "/" + dns.TypeToString[dns.TypeA]
+	value, err, shared := this.lookups.Do(key, func() (interface{}, error) {
+		return this.fetchUpstream(policy, domainName)
+	})
+	if shared {
+		atomic.AddInt64(&this.stats.CoalescedRequests, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	domain, ok := value.(*Domain)
+	if !ok {
+		return nil, errors.New("no answer for " + domainName)
 	}
+	return domain, nil
+}
+
+func (this *Server) fetchUpstream(policy *Policy, domainName string) (*Domain, error) {
+	result, err := policy.resolver.LookupHost(strings.TrimRight(domainName, "."))
+	if err != nil {
+		return nil, err
+	} else if len(result.Ips) == 0 {
+		return nil, &dns_resolver.NoAddressesError{Name: domainName}
+	}
+	answer := result.Ips[0]
+	this.logFor(nil, domainName).Infof("Fetched \"%s\" = %s from %s",
+		domainName, answer.Address, result.Server)
+	domain := &Domain{
+		Ip:       answer.Address,
+		Ttl:      answer.Ttl,
+		Name:     domainName,
+		Time:     time.Now().UnixNano(),
+		Block:    false,
+		Requests: 1,
+		Server:   result.Server,
+	}
+	// Cache before returning, so anyone asking after this call finishes finds the answer
+	this.store(policy, domain)
+	atomic.AddInt64(&this.stats.LookupRequests, 1)
+	this.addMetric(nil, Metric{
+		MetricType: "Fetch",
+		Time:       0,
+		Ip:         answer.Address,
+		Server:     result.Server,
+		Blocked:    false,
+		Domain:     domainName,
+	})
+	return domain, nil
+}
+
+// resolveCname answers domainName with the address of target, following local CNAME hosts up to MaxCnameDepth
+func (this *Server) resolveCname(client *Client, domainName string, target string, allowed bool, depth int, trace *Trace) (*Domain, string, error) {
+	if depth >= MaxCnameDepth {
+		this.addFailed(client, domainName)
+		trace.note("hosts", true, "too many CNAMEs")
+		return getFailedDomainObj(domainName), ResultFailed, errors.New("too many CNAMEs for " + domainName)
+	}
+	resolved, result, err := this.resolve(client, dns.Fqdn(target), allowed, depth+1, trace)
+	if err != nil {
+		return getFailedDomainObj(domainName), result, err
+	}
+	cnames := append([]string{resolved.Name}, resolved.Cnames...)
+	return &Domain{
+		Name:     domainName,
+		Cname:    cnames[len(cnames)-1],
+		Cnames:   cnames,
+		Ip:       resolved.Ip,
+		Ttl:      resolved.Ttl,
+		Time:     resolved.Time,
+		Block:    false,
+		Requests: 1,
+		Server:   resolved.Server,
+		Stale:    resolved.Stale,
+	}, result, nil
 }
 
 // Return True if Blocked
-func (this *Server) checkBlock(domain string) bool {
-	val, ok := lookupBoolInMap(this.config.Blocks, domain)
+func (this *Server) checkBlock(blocks map[string]bool, domain string) bool {
+	val, ok := lookupBoolInMap(blocks, domain)
 	return ok && val != nil && *val
 }
 
@@ -137,130 +250,246 @@ func (this *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		if recovered := recover(); recovered != nil {
 			fmt.Println("Recovering from:", r)
 			_ = w.Close()
-			this.stats.FailedRequests++
-			this.stats.FailedDomains = unique(append(this.stats.FailedDomains, r.Question[0].Name))
+			this.addFailed(nil, r.Question[0].Name)
+			this.recordQuery(r.Question[0], nil, nil, dns.RcodeServerFailure, ResultFailed, start)
 		}
 	}()
 	msg := dns.Msg{}
 	msg.SetReply(r)
+	client := this.identifyClient(w.RemoteAddr(), r)
+	outcome := ResultUnsupported
+	var answer *Domain
 	switch r.Question[0].Qtype {
 	case dns.TypeA:
 		msg.Authoritative = true
 		for _, question := range msg.Question {
 			domain := question.Name
-			result, err := this.getIp(domain)
+			result, how, err := this.getIp(domain, question.Qtype, client, nil)
+			outcome, answer = how, result
 			defer func() {
-				this.log.Infof("Lookup %s in %s -> %s",
+				this.logFor(client, domain).Infof("Lookup %s in %s -> %s",
 					domain, util.PrintTimeDiff(start), result.Ip)
-				this.addMetric(Metric{
+				this.addMetric(client, Metric{
 					MetricType: "Answer",
 					Time:       (time.Now().UnixNano() - start) / NanoConv,
 					Ip:         result.Ip,
 					Server:     result.Server,
 					Blocked:    false,
-					Domain:     result.Name,
+					Domain:     domain,
+					Client:     this.state().privacy.label(client, domain),
 				})
 			}()
 			if err == nil {
+				name := domain
+				for _, cname := range result.Cnames {
+					msg.Answer = append(msg.Answer, &dns.CNAME{
+						Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+						Target: cname,
+					})
+					name = cname
+				}
 				msg.Answer = append(msg.Answer, &dns.A{
-					Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
 					A:   net.ParseIP(result.Ip),
 				})
+				if result.Stale {
+					for _, answer := range msg.Answer {
+						answer.Header().Ttl = this.staleOptions().ttl
+					}
+				}
 			}
 		}
 	}
 	_ = w.WriteMsg(&msg)
+	this.recordQuery(r.Question[0], client, answer, msg.Rcode, outcome, start)
 }
 
-func New(port int) (*dns.Server, *Server) {
-	srv := &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
-	config, err := readConfig()
+// New sets up the server, with the command line's settings if there are any
+func New(overrides *Overrides) *Server {
+	client, err := newServer(overrides)
 	if err != nil {
 		fmt.Println("Error Reading the Config", err.Error())
-		return nil, nil
+		return nil
+	}
+	if client.activated, err = activation(); err != nil {
+		fmt.Println("Error Getting the Activated Sockets", err.Error())
+		return nil
+	}
+	client.queryLog = client.openQueryLog()
+	if err := client.loadHistory(); err != nil {
+		client.log.Warnf("Could not load history: %s", err.Error())
+	}
+	if err := client.loadSnapshot(); err != nil {
+		client.log.Warnf("Could not load cache snapshot: %s", err.Error())
 	}
-	client := &Server{
-		resolver:   dns_resolver.New(config.DnsServers, config.DohServer),
-		config:     config,
-		printMutex: &sync.Mutex{},
-		log:        logging.GetLogger(),
-		stats: Stats{
-			LookupRequests: 0,
-			CachedRequests: 0,
-			Domains:        make([]*Domain, 0),
-			Started:        time.Now().UnixNano(),
-			FailedDomains:  make([]string, 0),
-			Metrics:        make([]Metric, 0),
-		},
-	}
-	convertMapToMutex(config.Hosts).
-		Range(func(key, value interface{}) bool {
-			client.store(&Domain{
-				Name:  key.(string),
-				Ip:    value.(string),
-				Time:  time.Now().UnixNano(),
-				Block: false,
-			})
-			return true
-		})
-	srv.Handler = client
 	watcher, err := fsnotify.NewWatcher()
-	if err == nil && watcher.Add("/config.json") == nil {
+	if err == nil && watcher.Add(client.configFile) == nil {
 		go func() {
 			for {
 				select {
 				// watch for events
-				case _ = <-watcher.Events:
-					client.log.Info("Reloading Config File")
+				case event := <-watcher.Events:
+					if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+						// The file was replaced, by the admin API or an editor, and the watch went with the old one
+						client.rewatchConfig(watcher)
+					}
 					client.loadConfig()
 				}
 			}
 		}()
 	}
-	return srv, client
+	return client
+}
+
+// Load sets up the server with its filter lists loaded, but without serving, logging queries or watching
+// the config, so the command line can ask it how queries would be answered
+func Load(overrides *Overrides) (*Server, error) {
+	client, err := newServer(overrides)
+	if err != nil {
+		return nil, err
+	}
+	// A missing config file is not an error when serving, but here it is most likely a typo
+	if _, err := os.Stat(client.configFile); err != nil {
+		return nil, err
+	}
+	config := client.state().config
+	client.update(func(next *state) {
+		next.defaultPolicy, next.policies, next.schedules = client.buildPolicies(config, next.resolver)
+	})
+	return client, nil
 }
 
+// newServer reads the config and sets up what serving and loading have in common
+func newServer(overrides *Overrides) (*Server, error) {
+	configFile := DefaultConfigFile
+	if overrides != nil && overrides.ConfigFile != "" {
+		configFile = overrides.ConfigFile
+	}
+	config, _, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	client := &Server{
+		domains:     cache.New(getCacheOptions(config)),
+		arp:         newArpTable(),
+		lookups:     util.NewFlight(),
+		printMutex:  &sync.Mutex{},
+		log:         logging.GetLogger(),
+		stats:       newStatistics(time.Now().UnixNano(), config.MetricsSize),
+		history:     newHistory(config.History),
+		reports:     newReports(),
+		stream:      newBroadcaster(),
+		upstreams:   newUpstreams(),
+		filterLists: newFilterListCache(logging.GetLogger()),
+		prewarming:  make(chan bool, PrewarmConcurrency),
+		overrides:   overrides,
+		configFile:  configFile,
+	}
+	client.exporter = client.newExporter()
+	resolver := client.newResolver(config.DnsServers, config.DohServer)
+	// Filter lists are loaded in the background by PreStart, until then only the blocks apply
+	client.current.Store(&state{
+		config:        config,
+		resolver:      resolver,
+		defaultPolicy: &Policy{Name: DefaultPolicy, blocks: config.Blocks, resolver: resolver},
+		policies:      make([]*Policy, 0),
+		hosts:         getHosts(config),
+		privacy:       client.newPrivacy(config.Privacy, nil),
+		auth:          client.newAuth(config, nil),
+	})
+	return client, nil
+}
+
+// rewatchConfig watches the new config file once it is in place
+func (this *Server) rewatchConfig(watcher *fsnotify.Watcher) {
+	_ = watcher.Remove(this.configFile)
+	for i := 0; i < 10; i++ {
+		if err := watcher.Add(this.configFile); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	this.log.Errorf("Could not watch %s for changes", this.configFile)
+}
+
+// loadConfig applies the config file, unless neither it nor its modification time changed since it was last applied.
+// So the watcher noticing a file the admin API already applied does not load it all again, but touching it does
 func (this *Server) loadConfig() {
-	newConfig, err := readConfig()
+	this.reloadMutex.Lock()
+	defer this.reloadMutex.Unlock()
+	var modified time.Time
+	if info, err := os.Stat(this.configFile); err == nil {
+		modified = info.ModTime()
+	}
+	newConfig, data, err := readConfig(this.configFile)
 	if err != nil {
 		fmt.Println("Error Reading the Config", err.Error())
 		return
+	} else if this.applied != nil && bytes.Equal(data, this.applied) && modified.Equal(this.appliedModified) {
+		return
 	} else {
 		this.log.Info("Reloading Config File")
 	}
-	this.config = newConfig
-	this.resolver = dns_resolver.New(newConfig.DnsServers, newConfig.DohServer)
-	convertMapToMutex(newConfig.Hosts).
-		Range(func(key, value interface{}) bool {
-			this.domains.Store(key, &Domain{
-				Name:  key.(string),
-				Ip:    value.(string),
-				Time:  math.MaxInt64,
-				Block: false,
-				Ttl:   math.MaxUint32,
-			})
-			return true
-		})
+	this.filterLists.configure(newConfig)
+	// Filter lists are loaded before taking the lock, so queries are answered with the old state meanwhile
+	resolver := this.newResolver(newConfig.DnsServers, newConfig.DohServer)
+	defaultPolicy, policies, schedules := this.buildPolicies(newConfig, resolver)
+	this.update(func(next *state) {
+		next.config = newConfig
+		next.resolver = resolver
+		next.defaultPolicy, next.policies, next.schedules = defaultPolicy, policies, schedules
+		next.hosts = getHosts(newConfig)
+		next.privacy = this.newPrivacy(newConfig.Privacy, next.privacy)
+		next.auth = this.newAuth(newConfig, next.auth)
+	})
+	this.domains.Configure(getCacheOptions(newConfig))
+	this.applied, this.appliedModified = data, modified
+}
+
+// state is what queries are answered with right now. It must not be changed, use update instead
+func (this *Server) state() *state {
+	return this.current.Load().(*state)
+}
+
+// update publishes a copy of the state with the change made to it, one change at a time
+func (this *Server) update(change func(next *state)) {
+	this.updateMutex.Lock()
+	defer this.updateMutex.Unlock()
+	next := *this.state()
+	change(&next)
+	this.current.Store(&next)
 }
 
 func (this *Server) flushDns() error {
-	this.domains.Range(func(key, value interface{}) bool {
-		domain := value.(*Domain)
-		host := key.(string)
-		if !domain.Block {
-			// Remove all servers except for the blocked ones
-			this.domains.Delete(host)
-		}
-		return true
-	})
+	// Local hosts and the block list are kept apart from the cache, so they survive this
+	this.domains.Clear()
 	return nil
 }
 
+// sweepCache drops expired answers so they do not take up room until they are evicted
+func (this *Server) sweepCache() {
+	for {
+		interval := DefaultSweepInterval
+		if config := this.state().config; config.Cache != nil && config.Cache.SweepSeconds > 0 {
+			interval = time.Duration(config.Cache.SweepSeconds) * time.Second
+		}
+		time.Sleep(interval)
+		if removed := this.domains.Sweep(); removed > 0 {
+			this.log.Debugf("Swept %d Expired Entries from the Cache", removed)
+		}
+	}
+}
+
 func (this *Server) PreStart() {
 	this.startRest(this.flushDns)
+	go this.sweepCache()
+	go this.refreshStale()
+	go this.refreshFilterLists()
+	go this.snapshotCache()
+	go this.persistHistory()
 	go func() {
 		this.loadConfig()
 		time.Sleep(time.Second)
-		this.pullBlockList()
+		this.PullBlockList()
 	}()
 }
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+  "hosts": {"nas.test.": "10.0.0.2", "alias.test.": "nas.test", "*.wild.test.": "10.0.0.3"},
+  "blocks": {"blocked.test.": true},
+  "rules": ["||ads.test^", "@@||allowed.ads.test^"],
+  "servers": ["127.0.0.9"],
+  "groups": [{"name": "kids", "ips": ["10.1.0.0/16"], "blocks": {"games.test.": true}}]
+}`
+
+// testWriter keeps the reply instead of sending it
+type testWriter struct {
+	remote net.Addr
+	reply  *dns.Msg
+}
+
+func (this *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (this *testWriter) RemoteAddr() net.Addr           { return this.remote }
+func (this *testWriter) WriteMsg(msg *dns.Msg) error    { this.reply = msg; return nil }
+func (this *testWriter) Write(data []byte) (int, error) { return len(data), nil }
+func (this *testWriter) Close() error                   { return nil }
+func (this *testWriter) TsigStatus() error              { return nil }
+func (this *testWriter) TsigTimersOnly(bool)            {}
+func (this *testWriter) Hijack()                        {}
+
+// newTestServer loads the config from a temporary file, without serving or pulling the block list
+func newTestServer(t *testing.T, config string) *Server {
+	file, err := ioutil.TempFile("", "config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(file.Name()) })
+	if _, err = file.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+	srvr, err := Load(&Overrides{ConfigFile: file.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srvr
+}
+
+func writeConfig(t *testing.T, file string, config string) {
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Error(err)
+	}
+}
+
+func query(srvr *Server, name string, client string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	writer := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+	srvr.ServeDNS(writer, msg)
+	return writer.reply
+}
+
+// Run with -race, queries must only ever see a whole config while it is being reloaded
+func TestServeWhileReloading(t *testing.T) {
+	srvr := newTestServer(t, testConfig)
+	names := []string{"nas.test.", "alias.test.", "x.wild.test.", "blocked.test.", "ads.test.", "allowed.ads.test.", "games.test."}
+	clients := []string{"127.0.0.1", "10.1.2.3"}
+	done := make(chan bool)
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	// Each reload changes the config, an unchanged one would not be loaded again
+	configs := []string{testConfig, strings.Replace(testConfig, "10.0.0.2", "10.0.0.5", 1)}
+	reloaded := 0
+	go func() {
+		defer reloads.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				writeConfig(t, srvr.configFile, configs[reloaded%len(configs)])
+				srvr.loadConfig()
+				reloaded++
+			}
+		}
+	}()
+	var queries sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		queries.Add(1)
+		go func(i int) {
+			defer queries.Done()
+			for j := 0; j < 50; j++ {
+				name := names[(i+j)%len(names)]
+				reply := query(srvr, name, clients[(i+j)%len(clients)])
+				if reply == nil {
+					t.Errorf("no reply for %s", name)
+				}
+			}
+		}(i)
+	}
+	queries.Wait()
+	close(done)
+	reloads.Wait()
+	if reloaded < 2 {
+		t.Errorf("expected the config to be reloaded while queries were answered, it was reloaded %d times", reloaded)
+	}
+
+	if reply := query(srvr, "alias.test.", "127.0.0.1"); len(reply.Answer) != 2 {
+		t.Errorf("expected a CNAME and an address for alias.test., got %v", reply.Answer)
+	}
+	if reply := query(srvr, "games.test.", "10.1.2.3"); len(reply.Answer) != 0 {
+		t.Errorf("expected games.test. to be blocked for the kids group, got %v", reply.Answer)
+	}
+}
+
+// Every way of blocking is counted the same by /status and by Prometheus
+func TestBlockedCounters(t *testing.T) {
+	srvr := newTestServer(t, testConfig)
+	blocked := map[string]string{
+		"blocked.test.": "127.0.0.1",
+		"ads.test.":     "127.0.0.1",
+		"games.test.":   "10.1.2.3",
+	}
+	for name, client := range blocked {
+		if reply := query(srvr, name, client); len(reply.Answer) != 0 {
+			t.Errorf("expected %s to be blocked, got %v", name, reply.Answer)
+		}
+	}
+	query(srvr, "nas.test.", "127.0.0.1")
+
+	var metrics bytes.Buffer
+	if err := srvr.exporter.registry.Write(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	exported := 0.0
+	for _, line := range strings.Split(metrics.String(), "\n") {
+		if strings.HasPrefix(line, "dns_queries_total{") && strings.Contains(line, `result="blocked"`) {
+			value, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exported += value
+		}
+	}
+	status := srvr.status()
+	if status.BlockedRequests != int64(len(blocked)) || exported != float64(len(blocked)) {
+		t.Errorf("expected %d blocked, /status has %d and Prometheus has %v", len(blocked), status.BlockedRequests, exported)
+	}
+	if status.TotalRequests != int64(len(blocked)+1) {
+		t.Errorf("expected %d queries in total, /status has %d", len(blocked)+1, status.TotalRequests)
+	}
+}
+
+// Names privacy keeps out of the query log are left out of the recent metrics, top domains and failed domains too
+func TestPrivacyHidesNames(t *testing.T) {
+	srvr := newTestServer(t, strings.Replace(testConfig, `"servers"`,
+		`"privacy": {"ignoreDomains": ["*.hidden.test."]}, "servers"`, 1))
+	query(srvr, "nas.hidden.test.", "127.0.0.1")
+	query(srvr, "gone.hidden.test.", "127.0.0.1")
+	query(srvr, "nas.test.", "127.0.0.1")
+
+	stats := srvr.stats.snapshot(true)
+	for _, metric := range stats.Metrics {
+		if strings.HasSuffix(metric.Domain, "hidden.test.") {
+			t.Errorf("hidden name in the recent metrics: %+v", metric)
+		}
+	}
+	for _, name := range stats.FailedDomains {
+		if strings.HasSuffix(name, "hidden.test.") {
+			t.Errorf("hidden name in the failed domains: %s", name)
+		}
+	}
+	if stats.FailedRequests == 0 {
+		t.Errorf("hidden failures should still be counted")
+	}
+	history, err := srvr.history.query("", time.Now().Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Totals.Queries != 3 || len(history.Totals.Domains) != 1 || history.Totals.Domains["nas.test."] != 1 {
+		t.Errorf("expected 3 queries with only nas.test. named, got %d and %v", history.Totals.Queries, history.Totals.Domains)
+	}
+}
+
+// An IPv4 address hashes the same whether it is held in 4 or 16 bytes
+func TestAnonymizeIpv4Forms(t *testing.T) {
+	srvr := newTestServer(t, strings.Replace(testConfig, `"servers"`,
+		`"privacy": {"hashClients": true, "ipv4Prefix": 24}, "servers"`, 1))
+	privacy := srvr.state().privacy
+	short := privacy.anonymize(net.IPv4(192, 168, 1, 5).To4())
+	long := privacy.anonymize(net.IPv4(192, 168, 1, 9).To16())
+	if short == "" || short != long {
+		t.Errorf("expected the same hash for both forms, got %q and %q", short, long)
+	}
+}
+
+// The config is only loaded again once its contents or modification time change
+func TestReloadOnlyWhenChanged(t *testing.T) {
+	srvr := newTestServer(t, testConfig)
+	srvr.loadConfig()
+	loaded := srvr.state()
+	srvr.loadConfig()
+	if srvr.state() != loaded {
+		t.Errorf("an unchanged config should not be loaded again")
+	}
+	touched := time.Now().Add(time.Minute)
+	if err := os.Chtimes(srvr.configFile, touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	srvr.loadConfig()
+	if srvr.state() == loaded {
+		t.Errorf("touching the config should load it again")
+	}
+	loaded = srvr.state()
+	writeConfig(t, srvr.configFile, strings.Replace(testConfig, "10.0.0.2", "10.0.0.5", 1))
+	srvr.loadConfig()
+	if srvr.state() == loaded || srvr.state().hosts["nas.test."].Ip != "10.0.0.5" {
+		t.Errorf("a changed config should be loaded again")
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"gitlab.com/kamackay/dns/filter"
+	"gitlab.com/kamackay/dns/services"
+	"strings"
+)
+
+// blockedService is a service from the catalog with its rules compiled
+type blockedService struct {
+	name    string
+	filters *filter.List
+}
+
+// buildCatalog compiles every service in the catalog once, so groups can share them
+func (this *Server) buildCatalog(config *Config) map[string]*blockedService {
+	catalog, err := services.Load(config.ServicesFile)
+	if err != nil {
+		this.log.Warnf("Could not load services file %s: %s", config.ServicesFile, err.Error())
+	}
+	compiled := make(map[string]*blockedService)
+	for _, name := range catalog.Names() {
+		rules, _ := catalog.Rules([]string{name})
+		compiled[name] = &blockedService{
+			name:    name,
+			filters: this.loadFilters(rules, nil),
+		}
+	}
+	this.log.Infof("Loaded %d Services into the catalog", len(compiled))
+	return compiled
+}
+
+func (this *Server) selectServices(catalog map[string]*blockedService, names []string) []*blockedService {
+	selected := make([]*blockedService, 0)
+	for _, name := range names {
+		if service, ok := catalog[strings.ToLower(name)]; ok {
+			selected = append(selected, service)
+		} else {
+			this.log.Warnf("Unknown Service %s", name)
+		}
+	}
+	return selected
+}
+
+// checkServiceBlock returns the name of the blocked service the domain belongs to, if any
+func (this *Server) checkServiceBlock(policy *Policy, domainName string, qtype uint16, client *Client) (string, bool) {
+	for _, service := range policy.services {
+		if rule := service.filters.Match(domainName, qtype, client.filterClient()); rule != nil && !rule.Exception {
+			return service.name, true
+		}
+	}
+	return "", false
+}
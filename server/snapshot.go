@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// SnapshotVersion is bumped whenever the snapshot format changes, older snapshots are ignored
+const SnapshotVersion = 1
+
+type cacheSnapshot struct {
+	Version int              `json:"version"`
+	Saved   int64            `json:"saved"`
+	Entries []*snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Key string `json:"key"`
+	// Expires is absolute, so remaining TTLs account for the time the server was down
+	Expires int64   `json:"expires"`
+	Domain  *Domain `json:"domain"`
+}
+
+func (this *Server) snapshotFile() string {
+	config := this.state().config
+	if config.Snapshot == nil {
+		return ""
+	}
+	return config.Snapshot.File
+}
+
+// saveSnapshot writes the cache to disk, replacing the previous snapshot in one step
+func (this *Server) saveSnapshot() error {
+	file := this.snapshotFile()
+	if file == "" {
+		return nil
+	}
+	snapshot := cacheSnapshot{
+		Version: SnapshotVersion,
+		Saved:   time.Now().UnixNano(),
+		Entries: make([]*snapshotEntry, 0, this.domains.Len()),
+	}
+	this.domains.Range(func(key string, value interface{}, expires time.Time) bool {
+		snapshot.Entries = append(snapshot.Entries, &snapshotEntry{
+			Key:     key,
+			Expires: expires.UnixNano(),
+			Domain:  copyDomain(value.(*Domain)),
+		})
+		return true
+	})
+	data, err := jsoniter.Marshal(&snapshot)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(file, data); err != nil {
+		return err
+	}
+	this.log.Infof("Saved %d Cache Entries to %s", len(snapshot.Entries), file)
+	return nil
+}
+
+// loadSnapshot fills the cache from disk, skipping anything too old to be served
+func (this *Server) loadSnapshot() error {
+	file := this.snapshotFile()
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot cacheSnapshot
+	if err = jsoniter.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	cutoff := time.Now().Add(-getCacheOptions(this.state().config).Grace)
+	loaded := 0
+	for _, entry := range snapshot.Entries {
+		if entry.Domain == nil {
+			continue
+		}
+		expires := time.Unix(0, entry.Expires)
+		if expires.Before(cutoff) {
+			continue
+		}
+		this.domains.Set(entry.Key, entry.Domain, getDomainSize(entry.Domain), expires)
+		loaded++
+	}
+	this.log.Infof("Loaded %d of %d Cache Entries from %s, saved %s ago",
+		loaded, len(snapshot.Entries), file, time.Since(time.Unix(0, snapshot.Saved)).Round(time.Second))
+	return nil
+}
+
+// snapshotCache saves the cache periodically, so a crash loses at most one interval
+func (this *Server) snapshotCache() {
+	for {
+		interval := DefaultSnapshotInterval
+		if config := this.state().config; config.Snapshot != nil && config.Snapshot.IntervalSeconds > 0 {
+			interval = time.Duration(config.Snapshot.IntervalSeconds) * time.Second
+		}
+		time.Sleep(interval)
+		if err := this.saveSnapshot(); err != nil {
+			this.log.Errorf("Could not save cache snapshot: %s", err.Error())
+		}
+	}
+}
+
+// Shutdown saves the cache so the next start is not cold, the history so it has no gap,
+// and writes out the queries still waiting for the query log. Stop serving DNS first, queries answered after are not logged
+func (this *Server) Shutdown() {
+	if err := this.saveSnapshot(); err != nil {
+		this.log.Errorf("Could not save cache snapshot: %s", err.Error())
+	}
+	if err := this.saveHistory(); err != nil {
+		this.log.Errorf("Could not save history: %s", err.Error())
+	}
+	if err := this.queryLog.Close(); err != nil {
+		this.log.Errorf("Could not close the query log: %s", err.Error())
+	}
+}
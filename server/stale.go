@@ -0,0 +1,92 @@
+package server
+
+import (
+	"gitlab.com/kamackay/dns/dns_resolver"
+	"sync/atomic"
+	"time"
+)
+
+type staleOptions struct {
+	enabled  bool
+	maxStale time.Duration
+	ttl      uint32
+	refresh  time.Duration
+}
+
+// staleName is an answer that was served stale and still needs refreshing
+type staleName struct {
+	policy string
+	name   string
+}
+
+func getStaleOptions(config *Config) staleOptions {
+	options := staleOptions{
+		maxStale: DefaultMaxStale,
+		ttl:      DefaultStaleTtl,
+		refresh:  DefaultStaleRefresh,
+	}
+	if config.ServeStale == nil {
+		return options
+	}
+	options.enabled = config.ServeStale.Enabled
+	if config.ServeStale.MaxStaleSeconds > 0 {
+		options.maxStale = time.Duration(config.ServeStale.MaxStaleSeconds) * time.Second
+	}
+	if config.ServeStale.TtlSeconds > 0 {
+		options.ttl = uint32(config.ServeStale.TtlSeconds)
+	}
+	if config.ServeStale.RefreshSeconds > 0 {
+		options.refresh = time.Duration(config.ServeStale.RefreshSeconds) * time.Second
+	}
+	return options
+}
+
+func (this *Server) staleOptions() staleOptions {
+	return getStaleOptions(this.state().config)
+}
+
+// serveStale returns an expired answer when the upstreams could not be reached,
+// and queues the name to be refreshed in the background
+func (this *Server) serveStale(policy *Policy, domainName string, err error) (*Domain, bool) {
+	options := this.staleOptions()
+	if !options.enabled || !dns_resolver.IsUnreachable(err) {
+		return nil, false
+	}
+	key := policy.cacheKey(domainName)
+	value, expires, ok := this.domains.Peek(key)
+	if !ok || time.Since(expires) > options.maxStale {
+		return nil, false
+	}
+	stale := copyDomain(value.(*Domain))
+	stale.Stale = true
+	stale.Ttl = options.ttl
+	atomic.AddInt64(&this.stats.StaleRequests, 1)
+	this.staleNames.Store(key, &staleName{policy: policy.Name, name: domainName})
+	this.logFor(nil, domainName).Warnf("Serving stale answer for %s, expired %s ago", domainName, time.Since(expires).Round(time.Second))
+	return stale, true
+}
+
+// refreshStale retries the names that were served stale until the upstreams answer again
+func (this *Server) refreshStale() {
+	for {
+		options := this.staleOptions()
+		time.Sleep(options.refresh)
+		this.staleNames.Range(func(key, value interface{}) bool {
+			entry := value.(*staleName)
+			_, expires, ok := this.domains.Peek(key.(string))
+			if !ok || time.Since(expires) > options.maxStale {
+				// Nothing left to refresh, the next query will go upstream anyway
+				this.staleNames.Delete(key)
+				return true
+			}
+			_, err := this.fetch(this.policyByName(entry.policy), entry.name)
+			if err == nil {
+				this.logFor(nil, entry.name).Infof("Refreshed stale answer for %s", entry.name)
+				this.staleNames.Delete(key)
+			} else if !dns_resolver.IsUnreachable(err) {
+				this.staleNames.Delete(key)
+			}
+			return true
+		})
+	}
+}
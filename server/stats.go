@@ -0,0 +1,137 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// statistics is shared by every request, counters are only touched with sync/atomic.
+// The int64 fields come first to keep them aligned for atomic use on 32 bit platforms
+type statistics struct {
+	Started           int64
+	TotalRequests     int64
+	LookupRequests    int64
+	CachedRequests    int64
+	BlockedRequests   int64
+	FailedRequests    int64
+	StaleRequests     int64
+	PrefetchRequests  int64
+	CoalescedRequests int64
+
+	failedMutex   sync.Mutex
+	failedDomains map[string]bool
+	metrics       *metricRing
+}
+
+// metricRing keeps the most recent metrics, overwriting the oldest once it is full
+type metricRing struct {
+	mutex sync.Mutex
+	items []Metric
+	next  int
+	full  bool
+}
+
+func newStatistics(started int64, metricsSize int) *statistics {
+	return &statistics{
+		Started:       started,
+		failedDomains: make(map[string]bool),
+		metrics:       newMetricRing(metricsSize),
+	}
+}
+
+// addFailed counts a failed query, and keeps the domain unless it is empty
+func (this *statistics) addFailed(domainName string) {
+	atomic.AddInt64(&this.FailedRequests, 1)
+	if domainName == "" {
+		return
+	}
+	this.failedMutex.Lock()
+	this.failedDomains[domainName] = true
+	this.failedMutex.Unlock()
+}
+
+// snapshot copies the counters into a Stats, which is safe to hand out
+func (this *statistics) snapshot(withMetrics bool) Stats {
+	stats := Stats{
+		Started:           this.Started,
+		TotalRequests:     atomic.LoadInt64(&this.TotalRequests),
+		LookupRequests:    atomic.LoadInt64(&this.LookupRequests),
+		CachedRequests:    atomic.LoadInt64(&this.CachedRequests),
+		BlockedRequests:   atomic.LoadInt64(&this.BlockedRequests),
+		FailedRequests:    atomic.LoadInt64(&this.FailedRequests),
+		StaleRequests:     atomic.LoadInt64(&this.StaleRequests),
+		PrefetchRequests:  atomic.LoadInt64(&this.PrefetchRequests),
+		CoalescedRequests: atomic.LoadInt64(&this.CoalescedRequests),
+		Domains:           make([]*Domain, 0),
+		FailedDomains:     make([]string, 0),
+		Metrics:           make([]Metric, 0),
+	}
+	this.failedMutex.Lock()
+	for domainName := range this.failedDomains {
+		stats.FailedDomains = append(stats.FailedDomains, domainName)
+	}
+	this.failedMutex.Unlock()
+	sort.Strings(stats.FailedDomains)
+	if withMetrics {
+		stats.Metrics = this.metrics.list()
+	}
+	return stats
+}
+
+func newMetricRing(size int) *metricRing {
+	if size <= 0 {
+		size = DefaultMetricsSize
+	}
+	return &metricRing{items: make([]Metric, size)}
+}
+
+func (this *metricRing) add(metric Metric) {
+	this.mutex.Lock()
+	this.items[this.next] = metric
+	this.next = (this.next + 1) % len(this.items)
+	if this.next == 0 {
+		this.full = true
+	}
+	this.mutex.Unlock()
+}
+
+// list returns the metrics oldest first
+func (this *metricRing) list() []Metric {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.full {
+		return append([]Metric{}, this.items[:this.next]...)
+	}
+	return append(append([]Metric{}, this.items[this.next:]...), this.items[:this.next]...)
+}
+
+// addMetric keeps the metric for the recent metrics, unless privacy hides its domain
+func (this *Server) addMetric(client *Client, metric Metric) {
+	if !this.state().privacy.hides(client, metric.Domain) {
+		this.stats.metrics.add(metric)
+	}
+}
+
+// addFailed counts a failed query, leaving the domain out of the failed domains if privacy hides it
+func (this *Server) addFailed(client *Client, domainName string) {
+	if this.state().privacy.hides(client, domainName) {
+		domainName = ""
+	}
+	this.stats.addFailed(domainName)
+}
+
+// copyDomain copies a domain that other requests may still be counting against
+func copyDomain(domain *Domain) *Domain {
+	return &Domain{
+		Name:     domain.Name,
+		Time:     domain.Time,
+		Ip:       domain.Ip,
+		Cname:    domain.Cname,
+		Stale:    domain.Stale,
+		Block:    domain.Block,
+		Requests: atomic.LoadInt64(&domain.Requests),
+		Server:   domain.Server,
+		Ttl:      domain.Ttl,
+	}
+}
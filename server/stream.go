@@ -0,0 +1,118 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"gitlab.com/kamackay/dns/querylog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// StreamBuffer is how many events a slow subscriber can fall behind before events are dropped for it
+	StreamBuffer = 256
+	// StreamHeartbeat keeps idle streams from being closed by proxies
+	StreamHeartbeat = 15 * time.Second
+)
+
+// broadcaster hands every answered query to the live stream subscribers.
+// Publishing never blocks, so a slow subscriber only loses its own events
+type broadcaster struct {
+	mutex       sync.RWMutex
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	matcher *querylog.Matcher
+	events  chan *querylog.Entry
+	dropped int64
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subscribers: make(map[*subscriber]bool)}
+}
+
+func (this *broadcaster) subscribe(query querylog.Query) *subscriber {
+	listener := &subscriber{
+		matcher: querylog.NewMatcher(query),
+		events:  make(chan *querylog.Entry, StreamBuffer),
+	}
+	this.mutex.Lock()
+	this.subscribers[listener] = true
+	this.mutex.Unlock()
+	return listener
+}
+
+func (this *broadcaster) unsubscribe(listener *subscriber) {
+	this.mutex.Lock()
+	delete(this.subscribers, listener)
+	this.mutex.Unlock()
+}
+
+// active is checked before building an entry, so there is no cost when nobody is watching
+func (this *broadcaster) active() bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.subscribers) > 0
+}
+
+func (this *broadcaster) publish(entry *querylog.Entry) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	for listener := range this.subscribers {
+		if !listener.matcher.Match(entry) {
+			continue
+		}
+		select {
+		case listener.events <- entry:
+		default:
+			atomic.AddInt64(&listener.dropped, 1)
+		}
+	}
+}
+
+func (this *Server) streamRoutes(engine *gin.Engine) {
+	// Server-sent events for each query as it is answered, filtered like the query log search.
+	// A dropped event tells the client how many queries it missed by reading too slowly
+	engine.GET("/querylog/stream", func(ctx *gin.Context) {
+		query, _, err := parseLogQuery(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		listener := this.stream.subscribe(query)
+		defer this.stream.unsubscribe(listener)
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("Connection", "keep-alive")
+		// Stops nginx from buffering the stream
+		ctx.Header("X-Accel-Buffering", "no")
+		ctx.Status(http.StatusOK)
+		ctx.Writer.Flush()
+		heartbeat := time.NewTicker(StreamHeartbeat)
+		defer heartbeat.Stop()
+		var reported int64
+		for {
+			select {
+			case <-ctx.Request.Context().Done():
+				return
+			case entry := <-listener.events:
+				if dropped := atomic.LoadInt64(&listener.dropped); dropped > reported {
+					ctx.SSEvent("dropped", &streamDropped{Dropped: dropped - reported})
+					reported = dropped
+				}
+				ctx.SSEvent("query", entry)
+			case <-heartbeat.C:
+				if _, err := ctx.Writer.WriteString(": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+			ctx.Writer.Flush()
+		}
+	})
+}
+
+type streamDropped struct {
+	Dropped int64 `json:"dropped"`
+}
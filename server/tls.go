@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTlsReload is how often the certificate files are checked for changes
+const DefaultTlsReload = time.Minute
+
+// certificates keeps the HTTP API's certificate and client CA, loading them again whenever the files change,
+// so renewed certificates are used without a restart
+type certificates struct {
+	config *TlsConfig
+	mutex  sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+	// loaded is when each file was last modified, at the time it was loaded
+	loaded map[string]time.Time
+}
+
+func newCertificates(config *TlsConfig) (*certificates, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("certFile and keyFile are required for TLS")
+	}
+	if config.RequireClientCert && config.ClientCaFile == "" {
+		return nil, errors.New("clientCaFile is required to require client certificates")
+	}
+	certs := &certificates{config: config, loaded: make(map[string]time.Time)}
+	if _, err := certs.reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// reload loads the files again if any of them changed, reporting whether they did.
+// On an error the certificates already loaded are kept
+func (this *certificates) reload() (bool, error) {
+	files := []string{this.config.CertFile, this.config.KeyFile}
+	if this.config.ClientCaFile != "" {
+		files = append(files, this.config.ClientCaFile)
+	}
+	modified := make(map[string]time.Time)
+	changed := false
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modified[file] = info.ModTime()
+		if !info.ModTime().Equal(this.loaded[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(this.config.CertFile, this.config.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	var pool *x509.CertPool
+	if this.config.ClientCaFile != "" {
+		data, err := ioutil.ReadFile(this.config.ClientCaFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("no certificates found in %s", this.config.ClientCaFile)
+		}
+	}
+	this.mutex.Lock()
+	this.cert, this.pool, this.loaded = &cert, pool, modified
+	this.mutex.Unlock()
+	return true, nil
+}
+
+// tlsConfig is asked for on every handshake, so it always has the latest certificates
+func (this *certificates) tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*this.cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if this.pool != nil {
+		config.ClientCAs = this.pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if this.config.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// watchCertificates checks the certificate files for changes until the server stops
+func (this *Server) watchCertificates(certs *certificates) {
+	interval := DefaultTlsReload
+	if certs.config.ReloadSeconds > 0 {
+		interval = time.Duration(certs.config.ReloadSeconds) * time.Second
+	}
+	for {
+		time.Sleep(interval)
+		if changed, err := certs.reload(); err != nil {
+			this.log.Errorf("Could not reload the TLS certificate, keeping the old one: %s", err.Error())
+		} else if changed {
+			this.log.Info("Reloaded the TLS certificate")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"gitlab.com/kamackay/dns/filter"
+	"net"
+	"strings"
+	"time"
+)
+
+// errNotAsked ends a lookup being explained without asking the upstream servers
+var errNotAsked = errors.New("the upstream servers were not asked")
+
+// Explain works out how a query from the client would be answered, noting each check on the way, and every rule
+// that matches the name. With resolve it also looks the name up as ServeDNS would, otherwise it stops before
+// asking the upstream servers. It goes through the same checks as a query, so it counts in the stats like one
+func (this *Server) Explain(name string, qtype uint16, ip net.IP, id string, resolve bool) *Trace {
+	name = dns.Fqdn(strings.ToLower(name))
+	client := this.traceClient(name, qtype, ip, id)
+	trace := &Trace{
+		Name:    name,
+		Type:    typeName(qtype),
+		Client:  describeClient(client),
+		Group:   client.Policy.Name,
+		Steps:   make([]*TraceStep, 0),
+		Matches: this.matchRules(name, qtype, client),
+		local:   !resolve,
+	}
+	// The rules are judged for any type, but only A queries are looked up
+	if qtype != dns.TypeA && resolve {
+		trace.note("type", true, "only A queries are answered, anything else gets an empty reply")
+		trace.Result = ResultUnsupported
+		return trace
+	}
+	answer, result, err := this.getIp(name, qtype, client, trace)
+	trace.Result = result
+	if err == nil {
+		trace.Answer = answer
+	} else if result == ResultFailed {
+		trace.Error = err.Error()
+	}
+	return trace
+}
+
+// traceClient identifies the client as if the query came from its address with its client ID
+func (this *Server) traceClient(name string, qtype uint16, ip net.IP, id string) *Client {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	if id != "" {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EdnsClientIdOption, Data: []byte(id)})
+	}
+	return this.identifyClient(&net.UDPAddr{IP: ip}, msg)
+}
+
+func describeClient(client *Client) string {
+	parts := []string{client.Ip.String()}
+	if client.Mac != "" {
+		parts = append(parts, "MAC "+client.Mac)
+	}
+	if client.Id != "" {
+		parts = append(parts, "ID "+client.Id)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matchRules finds every rule and entry that matches the name for the client, whether or not it takes effect
+func (this *Server) matchRules(name string, qtype uint16, client *Client) []*RuleMatch {
+	policy := client.Policy
+	matches := make([]*RuleMatch, 0)
+	add := func(source string, list *filter.List) {
+		best := list.Match(name, qtype, client.filterClient())
+		for _, rule := range list.MatchAll(name, qtype, client.filterClient()) {
+			from := source
+			if rule.Source != "" {
+				from = rule.Source
+			}
+			matches = append(matches, &RuleMatch{Source: from, Rule: rule.Text, Exception: rule.Exception, Best: rule == best})
+		}
+	}
+	add("rules", policy.filters)
+	if blocked, ok := lookupBoolInMap(policy.blocks, name); ok {
+		matches = append(matches, &RuleMatch{Source: "blocks", Rule: fmt.Sprintf("%s: %t", name, *blocked), Exception: !*blocked, Best: true})
+	}
+	for _, service := range policy.services {
+		add("service "+service.name, service.filters)
+	}
+	now := time.Now()
+	for _, block := range policy.scheduled {
+		if !block.schedule.active(now) {
+			continue
+		}
+		source := "schedule " + block.schedule.name
+		if blocked, ok := lookupBoolInMap(block.blocks, name); ok {
+			matches = append(matches, &RuleMatch{Source: source, Rule: fmt.Sprintf("%s: %t", name, *blocked), Exception: !*blocked, Best: true})
+		}
+		add(source, block.filters)
+	}
+	add("block list", this.state().blockList)
+	return matches
+}
+
+// note records a check, if there is a trace, the detail is only formatted then
+func (this *Trace) note(check string, decided bool, format string, args ...interface{}) {
+	if this == nil {
+		return
+	}
+	this.Steps = append(this.Steps, &TraceStep{Check: check, Detail: fmt.Sprintf(format, args...), Decided: decided})
+}
+
+func describeRule(rule *filter.Rule) string {
+	if rule.Source == "" {
+		return rule.Text
+	}
+	return rule.Text + " from " + rule.Source
+}
+
+func describeList(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
@@ -2,29 +2,144 @@ package server
 
 import (
 	"github.com/sirupsen/logrus"
+	"gitlab.com/kamackay/dns/cache"
 	"gitlab.com/kamackay/dns/dns_resolver"
+	"gitlab.com/kamackay/dns/filter"
+	"gitlab.com/kamackay/dns/querylog"
+	"gitlab.com/kamackay/dns/util"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	resolver   *dns_resolver.DnsResolver
-	domains    sync.Map
-	config     *Config
-	log        *logrus.Logger
-	printMutex *sync.Mutex
-	stats      Stats
+	// current is the *state queries are answered with, replaced whole when the config is reloaded
+	current     atomic.Value
+	updateMutex sync.Mutex
+	domains     *cache.Cache
+	arp         *arpTable
+	lookups     *util.Flight
+	log         *logrus.Logger
+	printMutex  *sync.Mutex
+	// staleNames are answers served stale, waiting to be refreshed once upstreams recover
+	staleNames sync.Map
+	// prefetching are the answers with a refresh in flight
+	prefetching sync.Map
+	// prewarming holds a slot for each prewarm lookup in flight
+	prewarming  chan bool
+	stats       *statistics
+	exporter    *exporter
+	history     *history
+	reports     *reports
+	queryLog    *querylog.Writer
+	stream      *broadcaster
+	upstreams   *upstreams
+	overrides   *Overrides
+	activated   *activatedSockets
+	configFile  string
+	filterLists *filterListCache
+	// reloadMutex makes reloads one at a time, applied is the config file as it was last loaded
+	reloadMutex     sync.Mutex
+	applied         []byte
+	appliedModified time.Time
+}
+
+// state is everything built from the config and the pulled block list. Once published it is never changed,
+// so a query sees one whole config even while a reload is building the next state
+type state struct {
+	config        *Config
+	resolver      *dns_resolver.DnsResolver
+	defaultPolicy *Policy
+	policies      []*Policy
+	schedules     map[string]*schedule
+	hosts         map[string]*Domain
+	privacy       *privacy
+	auth          *authenticator
+	blockList     *filter.List
+	// blockListPulled is when the block list was last pulled, in milliseconds
+	blockListPulled int64
 }
 
 type Stats struct {
-	Started         int64
-	Running         *string   `json:"running"`
-	LookupRequests  int64     `json:"lookupRequests"`
-	CachedRequests  int64     `json:"cachedRequests"`
-	BlockedRequests int64     `json:"blockedRequests"`
-	FailedRequests  int64     `json:"failedRequests"`
-	Domains         []*Domain `json:"domains"`
-	FailedDomains   []string  `json:"failedDomains"`
-	Metrics         []Metric  `json:"metrics"`
+	Started           int64
+	Running           *string     `json:"running"`
+	TotalRequests     int64       `json:"totalRequests"`
+	LookupRequests    int64       `json:"lookupRequests"`
+	CachedRequests    int64       `json:"cachedRequests"`
+	BlockedRequests   int64       `json:"blockedRequests"`
+	FailedRequests    int64       `json:"failedRequests"`
+	StaleRequests     int64       `json:"staleRequests"`
+	PrefetchRequests  int64       `json:"prefetchRequests"`
+	CoalescedRequests int64       `json:"coalescedRequests"`
+	Domains           []*Domain   `json:"domains"`
+	FailedDomains     []string    `json:"failedDomains"`
+	Metrics           []Metric    `json:"metrics"`
+	ActiveSchedules   []string    `json:"activeSchedules"`
+	Cache             cache.Stats `json:"cache"`
+}
+
+// Status is the state of the server shown on the dashboard
+type Status struct {
+	Started         int64             `json:"started"`
+	Running         string            `json:"running"`
+	TotalRequests   int64             `json:"totalRequests"`
+	LookupRequests  int64             `json:"lookupRequests"`
+	CachedRequests  int64             `json:"cachedRequests"`
+	BlockedRequests int64             `json:"blockedRequests"`
+	FailedRequests  int64             `json:"failedRequests"`
+	Cache           cache.Stats       `json:"cache"`
+	BlockList       BlockListStatus   `json:"blockList"`
+	Groups          []*GroupStatus    `json:"groups"`
+	Hosts           int               `json:"hosts"`
+	Upstreams       []*UpstreamStatus `json:"upstreams"`
+	ActiveSchedules []string          `json:"activeSchedules"`
+	QueryLog        bool              `json:"queryLog"`
+}
+
+type BlockListStatus struct {
+	Rules int `json:"rules"`
+	// Pulled is zero until the block list has been pulled
+	Pulled int64 `json:"pulled"`
+}
+
+type GroupStatus struct {
+	Name   string `json:"name"`
+	Rules  int    `json:"rules"`
+	Blocks int    `json:"blocks"`
+}
+
+// Trace is how a query would be answered, from Explain
+type Trace struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Client string       `json:"client"`
+	Group  string       `json:"group"`
+	Steps  []*TraceStep `json:"steps"`
+	// Matches are every rule matching the name, including ones that do not take effect
+	Matches []*RuleMatch `json:"matches"`
+	// Result is one of the Result constants, empty if the query was not resolved
+	Result string  `json:"result"`
+	Answer *Domain `json:"answer,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	// local stops the lookup before the upstream servers are asked
+	local bool
+}
+
+type TraceStep struct {
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+	// Decided is set on the step that settled the answer
+	Decided bool `json:"decided"`
+}
+
+type RuleMatch struct {
+	// Source is the filter list, service, schedule or other part of the config the rule is from
+	Source    string `json:"source"`
+	Rule      string `json:"rule"`
+	Exception bool   `json:"exception"`
+	// Best is set on the rule that wins out over the others from the same source
+	Best bool `json:"best"`
 }
 
 type Config struct {
@@ -32,16 +147,252 @@ type Config struct {
 	Blocks     map[string]bool        `json:"blocks"`
 	DnsServers []string               `json:"servers"`
 	DohServer  *string                `json:"dohServer"`
+	// Rules are AdGuard/ABP style filter rules, FilterLists are files or URLs of them
+	Rules       []string             `json:"rules"`
+	FilterLists []string             `json:"filterLists"`
+	Groups      []*ClientGroup       `json:"groups"`
+	Schedules   map[string]*Schedule `json:"schedules"`
+	// ScheduledBlocks apply to every group that does not define its own
+	ScheduledBlocks []*ScheduledBlock `json:"scheduledBlocks"`
+	// SafeSearch rewrites search engines to their safe search CNAMEs
+	SafeSearch bool `json:"safeSearch"`
+	// FilterListRefreshHours is how long a downloaded filter list is used before it is downloaded again
+	FilterListRefreshHours int `json:"filterListRefreshHours"`
+	// BlockedServices are names from the services catalog, ServicesFile adds to or overrides it
+	BlockedServices []string        `json:"blockedServices"`
+	ServicesFile    string          `json:"servicesFile"`
+	Cache           *CacheConfig    `json:"cache"`
+	ServeStale      *StaleConfig    `json:"serveStale"`
+	Prefetch        *PrefetchConfig `json:"prefetch"`
+	Snapshot        *SnapshotConfig `json:"snapshot"`
+	// MetricsSize is how many recent metrics are kept, read once at startup
+	MetricsSize int             `json:"metricsSize"`
+	History     *HistoryConfig  `json:"history"`
+	QueryLog    *QueryLogConfig `json:"queryLog"`
+	Privacy     *PrivacyConfig  `json:"privacy"`
+	// HostsFile is where every known host name is dumped for debugging, nothing is written if empty
+	HostsFile string `json:"hostsFile"`
+	// AdminToken is a bearer token with the admin role, the same as one in Auth.Tokens
+	AdminToken string      `json:"adminToken"`
+	Auth       *AuthConfig `json:"auth"`
+	// CorsOrigins may call the API from other sites in a browser, like https://example.com, or * for any
+	CorsOrigins []string      `json:"corsOrigins"`
+	Http        *HttpConfig   `json:"http"`
+	Listen      *ListenConfig `json:"listen"`
+}
+
+// ListenConfig is where DNS is served, read once at startup. Addresses are like :53, 127.0.0.1:53, [::1]:53
+// or an interface name like eth0:53, which listens on each of its addresses. Only UDP on :53 if both are empty
+type ListenConfig struct {
+	Udp         []string `json:"udp"`
+	Tcp         []string `json:"tcp"`
+	DisableIpv4 bool     `json:"disableIpv4"`
+	DisableIpv6 bool     `json:"disableIpv6"`
+}
+
+// HttpConfig is where the HTTP API listens, read once at startup.
+// Listen are addresses like :9999 or 127.0.0.1:9999, DefaultHttpListen if empty
+type HttpConfig struct {
+	Listen []string   `json:"listen"`
+	Tls    *TlsConfig `json:"tls"`
+}
+
+// TlsConfig serves the HTTP API over HTTPS. The files are checked every ReloadSeconds and loaded again
+// when they change. With ClientCaFile, client certificates are verified against it, and with
+// RequireClientCert clients without one are turned away
+type TlsConfig struct {
+	CertFile          string `json:"certFile"`
+	KeyFile           string `json:"keyFile"`
+	ClientCaFile      string `json:"clientCaFile"`
+	RequireClientCert bool   `json:"requireClientCert"`
+	ReloadSeconds     int    `json:"reloadSeconds"`
+}
+
+// AuthConfig protects the HTTP API. Reading needs the read role and changing anything the admin role.
+// The API is open while no tokens, users or issuer are configured, except for /admin which is off
+type AuthConfig struct {
+	Tokens []*ApiToken `json:"tokens"`
+	Users  []*ApiUser  `json:"users"`
+	Oidc   *OidcConfig `json:"oidc"`
+}
+
+// ApiToken is sent as a bearer token, Role is read or admin
+type ApiToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// ApiUser signs in with HTTP basic auth, PasswordHash is a bcrypt hash like htpasswd -B makes
+type ApiUser struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"passwordHash"`
+	Role         string `json:"role"`
+}
+
+// OidcConfig accepts bearer tokens signed by Issuer for ClientId. Users get the admin role if RoleClaim
+// holds one of AdminGroups, and the read role if it holds one of ReadGroups, or always if ReadGroups is empty
+type OidcConfig struct {
+	Issuer      string   `json:"issuer"`
+	ClientId    string   `json:"clientId"`
+	RoleClaim   string   `json:"roleClaim"`
+	AdminGroups []string `json:"adminGroups"`
+	ReadGroups  []string `json:"readGroups"`
+}
+
+// PrivacyConfig limits what the query log and the per client reports record.
+// Clients are truncated to Ipv4Prefix and Ipv6Prefix bits, then hashed with a salt
+// replaced every SaltRotationHours if HashClients is set. Ignored clients and domains,
+// or everything with DisableLogging, are still counted in the stats, history and metrics
+type PrivacyConfig struct {
+	DisableLogging    bool     `json:"disableLogging"`
+	Ipv4Prefix        int      `json:"ipv4Prefix"`
+	Ipv6Prefix        int      `json:"ipv6Prefix"`
+	HashClients       bool     `json:"hashClients"`
+	SaltRotationHours int      `json:"saltRotationHours"`
+	IgnoreClients     []string `json:"ignoreClients"`
+	IgnoreDomains     []string `json:"ignoreDomains"`
+}
+
+// QueryLogConfig writes every query to File as JSON lines, read once at startup.
+// A new file is started past MaxSizeMb or MaxAgeHours, and rotated files are removed
+// past MaxFiles or RetentionDays
+type QueryLogConfig struct {
+	Enabled       bool   `json:"enabled"`
+	File          string `json:"file"`
+	MaxSizeMb     int    `json:"maxSizeMb"`
+	MaxAgeHours   int    `json:"maxAgeHours"`
+	MaxFiles      int    `json:"maxFiles"`
+	RetentionDays int    `json:"retentionDays"`
+	Compress      bool   `json:"compress"`
+	BufferSize    int    `json:"bufferSize"`
+}
+
+// HistoryConfig sets how long each resolution of the query history is kept, read once at startup.
+// File saves the history every IntervalSeconds and on shutdown, so it survives restarts
+type HistoryConfig struct {
+	File                 string `json:"file"`
+	IntervalSeconds      int    `json:"intervalSeconds"`
+	TopDomains           int    `json:"topDomains"`
+	MinuteRetentionHours int    `json:"minuteRetentionHours"`
+	HourRetentionDays    int    `json:"hourRetentionDays"`
+	DayRetentionDays     int    `json:"dayRetentionDays"`
+}
+
+// SnapshotConfig saves the cache to File on shutdown and every IntervalSeconds, and loads it on start
+type SnapshotConfig struct {
+	File            string `json:"file"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+}
+
+// PrefetchConfig refreshes popular answers before they expire, so they never miss the cache
+type PrefetchConfig struct {
+	Enabled bool `json:"enabled"`
+	// Percent is how much of the TTL is left when the refresh happens
+	Percent int `json:"percent"`
+	// MinRequests is how many times an answer has to be used before it is worth refreshing
+	MinRequests int64 `json:"minRequests"`
+}
+
+// StaleConfig controls answering from expired cache entries when every upstream fails (RFC 8767)
+type StaleConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxStaleSeconds is how long past expiry an answer can still be used
+	MaxStaleSeconds int `json:"maxStaleSeconds"`
+	// TtlSeconds is the TTL sent with stale answers
+	TtlSeconds int `json:"ttlSeconds"`
+	// RefreshSeconds is how often stale names are retried upstream in the background
+	RefreshSeconds int `json:"refreshSeconds"`
+}
+
+// CacheConfig bounds the answer cache, DefaultCacheEntries and DefaultCacheBytes are used when unset
+type CacheConfig struct {
+	MaxEntries int   `json:"maxEntries"`
+	MaxBytes   int64 `json:"maxBytes"`
+	// Eviction is "lru" or "lfu"
+	Eviction     string `json:"eviction"`
+	SweepSeconds int    `json:"sweepSeconds"`
+}
+
+// Schedule is a weekly time window, such as school nights from 21:00 to 07:00
+type Schedule struct {
+	// Days are the days the window starts on, every day if empty
+	Days []string `json:"days"`
+	// Start and End are HH:MM, an End before Start runs past midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is an IANA name like America/New_York, the server's local time if empty
+	Timezone string `json:"timezone"`
+}
+
+// ScheduledBlock blocks domains only while its schedule is active
+type ScheduledBlock struct {
+	Schedule string          `json:"schedule"`
+	Blocks   map[string]bool `json:"blocks"`
+	Rules    []string        `json:"rules"`
+}
+
+// ClientGroup applies its own policy to the clients it matches.
+// Any policy field left empty falls back to the top level Config
+type ClientGroup struct {
+	Name string `json:"name"`
+	// Ips can hold single addresses or CIDR ranges
+	Ips []string `json:"ips"`
+	// Macs are matched through the ARP table, so only work for clients on the local network
+	Macs []string `json:"macs"`
+	// ClientIds are matched against the EDNS0 client ID option sent by the client
+	ClientIds   []string        `json:"clientIds"`
+	Blocks      map[string]bool `json:"blocks"`
+	Rules       []string        `json:"rules"`
+	FilterLists []string        `json:"filterLists"`
+	DnsServers  []string        `json:"servers"`
+	DohServer   *string         `json:"dohServer"`
+	// Schedule limits when clients are put in this group, always if empty
+	Schedule        string            `json:"schedule"`
+	ScheduledBlocks []*ScheduledBlock `json:"scheduledBlocks"`
+	SafeSearch      *bool             `json:"safeSearch"`
+	BlockedServices []string          `json:"blockedServices"`
+}
+
+// Policy is the compiled form of a ClientGroup, or of the top level Config for the default policy
+type Policy struct {
+	Name     string
+	group    *ClientGroup
+	blocks   map[string]bool
+	filters  *filter.List
+	resolver *dns_resolver.DnsResolver
+	// schedule is when the group applies, scheduled are blocks with their own windows
+	schedule   *schedule
+	scheduled  []*scheduledBlock
+	safeSearch bool
+	services   []*blockedService
+	// cacheScope keeps answers from a group's own servers apart, empty when using the shared upstreams
+	cacheScope string
+	subnets    []*net.IPNet
+	macs       map[string]bool
+	ids        map[string]bool
+}
+
+// Client is the sender of a query and the policy chosen for them
+type Client struct {
+	Ip     net.IP
+	Mac    string
+	Id     string
+	Policy *Policy
 }
 
 type Domain struct {
 	Name     string `json:"name"`
 	Time     int64  `json:"time"`
 	Ip       string `json:"ip"`
+	Cname    string `json:"cname,omitempty"`
+	Stale    bool   `json:"stale,omitempty"`
 	Block    bool   `json:"block"`
 	Requests int64  `json:"requests"`
 	Server   string `json:"server"`
 	Ttl      uint32 `json:"ttl"`
+	// Cnames are the names followed to reach the address, in order, ending with Cname
+	Cnames []string `json:"cnames,omitempty"`
 }
 
 type Metric struct {
@@ -51,4 +402,6 @@ type Metric struct {
 	Server     string `json:"server"`
 	Blocked    bool   `json:"blocked"`
 	Domain     string `json:"domain"`
+	// Client is the address that asked, only set on answers
+	Client string `json:"client,omitempty"`
 }
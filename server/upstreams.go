@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// upstreamWeight is how much each answer moves the average latency of an upstream
+const upstreamWeight = 0.2
+
+// UpstreamStatus is how an upstream server has been answering since the server started
+type UpstreamStatus struct {
+	Server  string `json:"server"`
+	Queries int64  `json:"queries"`
+	Errors  int64  `json:"errors"`
+	// LatencyMs is a moving average, so it follows the recent answers
+	LatencyMs   float64 `json:"latencyMs"`
+	LastSuccess int64   `json:"lastSuccess,omitempty"`
+	LastFailure int64   `json:"lastFailure,omitempty"`
+	LastError   string  `json:"lastError,omitempty"`
+	// Healthy is false when the last query to the server failed
+	Healthy bool `json:"healthy"`
+}
+
+type upstreams struct {
+	mutex   sync.Mutex
+	servers map[string]*UpstreamStatus
+}
+
+func newUpstreams() *upstreams {
+	return &upstreams{servers: make(map[string]*UpstreamStatus)}
+}
+
+func (this *upstreams) observe(server string, took time.Duration, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	status, ok := this.servers[server]
+	if !ok {
+		status = &UpstreamStatus{Server: server}
+		this.servers[server] = status
+	}
+	status.Queries++
+	now := time.Now().UnixNano() / NanoConv
+	if err != nil {
+		status.Errors++
+		status.LastFailure = now
+		status.LastError = err.Error()
+		status.Healthy = false
+		return
+	}
+	latency := float64(took) / float64(time.Millisecond)
+	if status.LastSuccess == 0 {
+		status.LatencyMs = latency
+	} else {
+		status.LatencyMs += upstreamWeight * (latency - status.LatencyMs)
+	}
+	status.LastSuccess = now
+	status.Healthy = true
+}
+
+// list copies every upstream that has been asked, by server
+func (this *upstreams) list() []*UpstreamStatus {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	list := make([]*UpstreamStatus, 0, len(this.servers))
+	for _, status := range this.servers {
+		copied := *status
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Server < list[j].Server
+	})
+	return list
+}
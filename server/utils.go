@@ -1,16 +1,26 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"gitlab.com/kamackay/dns/cache"
+	"gitlab.com/kamackay/dns/filter"
 	"gitlab.com/kamackay/dns/wildcard"
+	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,19 +32,39 @@ const (
 	Ok        int8 = 0
 	Block     int8 = 1
 	NotFound  int8 = 2
-)
+	// MaxCnameDepth limits how many local CNAME hosts are followed for one query
+	MaxCnameDepth = 8
 
-func (this *Server) addMetric(metric Metric) {
-	this.stats.Metrics = append(this.stats.Metrics, metric)
-}
+	DefaultCacheEntries        = 10_000
+	DefaultCacheBytes          = 16 * 1024 * 1024
+	DefaultSweepInterval       = time.Minute
+	DefaultMaxStale            = 24 * time.Hour
+	DefaultStaleTtl            = 30
+	DefaultStaleRefresh        = 30 * time.Second
+	DefaultPrefetchPercent     = 10
+	DefaultPrefetchMinRequests = 5
+	DefaultSnapshotInterval    = 5 * time.Minute
+	DefaultMetricsSize         = 1000
+	DefaultHistoryInterval     = 5 * time.Minute
+	DefaultHistoryTopDomains   = 20
+	DefaultMinuteRetention     = 24 * time.Hour
+	DefaultHourRetention       = 30 * 24 * time.Hour
+	DefaultDayRetention        = 365 * 24 * time.Hour
+	DefaultQueryLogFile        = "/app/logs/queries.jsonl"
+	DefaultConfigFile          = "/config.json"
+	DefaultHttpListen          = ":9999"
+	DefaultFilterListRefresh   = 24 * time.Hour
+	// DomainOverhead is the rough size of a cached Domain and its bookkeeping, without its strings
+	DomainOverhead = 200
 
-func convertMapToMutex(slice map[string]interface{}) *sync.Map {
-	var mutexMap sync.Map
-	for key, value := range slice {
-		mutexMap.Store(key, value)
-	}
-	return &mutexMap
-}
+	// How a query was answered
+	ResultCached      = "cached"
+	ResultForwarded   = "forwarded"
+	ResultBlocked     = "blocked"
+	ResultFailed      = "failed"
+	ResultStale       = "stale"
+	ResultUnsupported = "unsupported"
+)
 
 func unique(slice []string) []string {
 	keys := make(map[string]bool)
@@ -48,57 +78,251 @@ func unique(slice []string) []string {
 	return list
 }
 
-func convertMutexToMap(mutex *sync.Map) map[string]*Domain {
-	slice := make(map[string]*Domain)
-	mutex.Range(func(key, value interface{}) bool {
-		slice[key.(string)] = value.(*Domain)
-		return true
-	})
-	return slice
-}
-
-func (this *Server) pullBlockList() {
+// PullBlockList replaces the block list with the latest one, keeping the old one if it can not be fetched
+func (this *Server) PullBlockList() {
 	var list []string
 	err := getJson("https://api.keith.sh/ls.json", &list)
 	if err == nil {
 		this.log.Infof("Pulled %d Servers to Block", len(list))
+		blockList := filter.NewList()
 		for _, server := range list {
-			name := fmt.Sprintf("^(.*\\.)?%s\\.$", server)
-			this.domains.Store(name, &Domain{
-				Name:     name,
-				Time:     time.Now().UnixNano(),
-				Ip:       BlockedIp,
-				Block:    true,
-				Server:   NoServer,
-				Requests: 0,
-				Ttl:      math.MaxUint32,
+			if err := blockList.Add(fmt.Sprintf("||%s^", server)); err != nil {
+				this.log.Debugf("Invalid Server to Block: %s", err.Error())
+			}
+		}
+		this.update(func(next *state) {
+			next.blockList = blockList
+			next.blockListPulled = time.Now().UnixNano() / NanoConv
+		})
+	}
+}
+
+// loadFilters builds the filter list from the inline rules and every configured filter list
+func (this *Server) loadFilters(rules []string, sources []string) *filter.List {
+	list := filter.NewList()
+	for _, line := range rules {
+		if err := list.Add(line); err != nil {
+			this.log.Warnf("Invalid Rule: %s", err.Error())
+		}
+	}
+	for _, source := range sources {
+		reader, err := this.filterLists.open(source)
+		if err != nil {
+			this.log.Errorf("Could not load filter list %s: %s", source, err.Error())
+			continue
+		}
+		added, errs := list.AddSource(reader, source)
+		_ = reader.Close()
+		this.log.Infof("Loaded %d Rules from %s (%d invalid)", added, source, len(errs))
+		for _, err := range errs {
+			this.log.Debugf("Invalid Rule in %s: %s", source, err.Error())
+		}
+	}
+	return list
+}
+
+// filterListCache keeps the filter lists downloaded from the web, so reloading the config only downloads
+// the lists it did not have before, or that are older than the refresh interval. Files are read again every time
+type filterListCache struct {
+	mutex   sync.Mutex
+	lists   map[string]*downloadedList
+	refresh time.Duration
+	log     *logrus.Logger
+}
+
+type downloadedList struct {
+	data    []byte
+	fetched time.Time
+}
+
+func newFilterListCache(log *logrus.Logger) *filterListCache {
+	return &filterListCache{lists: make(map[string]*downloadedList), refresh: DefaultFilterListRefresh, log: log}
+}
+
+func (this *filterListCache) open(source string) (io.ReadCloser, error) {
+	if !isRemoteList(source) {
+		return os.Open(source)
+	}
+	this.mutex.Lock()
+	list, ok := this.lists[source]
+	refresh := this.refresh
+	this.mutex.Unlock()
+	if ok && time.Since(list.fetched) < refresh {
+		return ioutil.NopCloser(bytes.NewReader(list.data)), nil
+	}
+	data, err := download(source)
+	if err != nil && ok {
+		// An outdated list blocks more than no list at all, it is downloaded again on the next refresh
+		this.log.Warnf("Could not refresh filter list %s, using the copy from %s: %s",
+			source, list.fetched.Format(time.RFC3339), err.Error())
+		return ioutil.NopCloser(bytes.NewReader(list.data)), nil
+	} else if err != nil {
+		return nil, err
+	}
+	this.mutex.Lock()
+	this.lists[source] = &downloadedList{data: data, fetched: time.Now()}
+	this.mutex.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func download(source string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	r, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", r.Status)
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// configure takes the refresh interval from the config, and forgets the lists it no longer uses
+func (this *filterListCache) configure(config *Config) {
+	used := make(map[string]bool)
+	for _, source := range remoteLists(config) {
+		used[source] = true
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.refresh = getFilterListRefresh(config)
+	for source := range this.lists {
+		if !used[source] {
+			delete(this.lists, source)
+		}
+	}
+}
+
+func getFilterListRefresh(config *Config) time.Duration {
+	if config.FilterListRefreshHours > 0 {
+		return time.Duration(config.FilterListRefreshHours) * time.Hour
+	}
+	return DefaultFilterListRefresh
+}
+
+func isRemoteList(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// remoteLists are the filter lists of the config that are downloaded, for every group
+func remoteLists(config *Config) []string {
+	sources := append([]string{}, config.FilterLists...)
+	for _, group := range config.Groups {
+		if group != nil {
+			sources = append(sources, group.FilterLists...)
+		}
+	}
+	lists := make([]string, 0)
+	for _, source := range sources {
+		if isRemoteList(source) {
+			lists = append(lists, source)
+		}
+	}
+	return lists
+}
+
+// refreshFilterLists builds the filters again each refresh interval, which downloads the lists that are due
+func (this *Server) refreshFilterLists() {
+	for {
+		time.Sleep(getFilterListRefresh(this.state().config))
+		this.reloadMutex.Lock()
+		current := this.state()
+		if len(remoteLists(current.config)) > 0 {
+			this.log.Info("Refreshing Filter Lists")
+			defaultPolicy, policies, schedules := this.buildPolicies(current.config, current.resolver)
+			this.update(func(next *state) {
+				next.defaultPolicy, next.policies, next.schedules = defaultPolicy, policies, schedules
 			})
 		}
+		this.reloadMutex.Unlock()
 	}
 }
 
+func getRemoteIp(addr net.Addr) net.IP {
+	switch address := addr.(type) {
+	case *net.UDPAddr:
+		return address.IP
+	case *net.TCPAddr:
+		return address.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 func (this *Server) printAllHosts() {
+	current := this.state()
+	if current.config.HostsFile == "" {
+		return
+	}
 	this.printMutex.Lock()
 	hosts := make([]string, 0)
-	this.domains.Range(func(key, _ interface{}) bool {
-		hosts = append(hosts, key.(string))
+	for name := range current.hosts {
+		hosts = append(hosts, name)
+	}
+	this.domains.Range(func(key string, _ interface{}, _ time.Time) bool {
+		hosts = append(hosts, key)
 		return true
 	})
 	str := strings.Join(hosts, "\n")
-	ioutil.WriteFile("/app/hosts.txt", []byte(str+"\n"), 0644)
+	ioutil.WriteFile(current.config.HostsFile, []byte(str+"\n"), 0644)
 	this.printMutex.Unlock()
 }
 
-func readConfig() (*Config, error) {
-	data, err := ioutil.ReadFile("/config.json")
+// getHosts builds the local host entries from the config
+func getHosts(config *Config) map[string]*Domain {
+	hosts := make(map[string]*Domain)
+	for name, value := range config.Hosts {
+		hosts[name] = getHostDomainObj(name, value)
+	}
+	return hosts
+}
+
+func getCacheOptions(config *Config) cache.Options {
+	options := cache.Options{
+		MaxEntries: DefaultCacheEntries,
+		MaxBytes:   DefaultCacheBytes,
+		Eviction:   cache.LRU,
+	}
+	if config.Cache != nil {
+		if config.Cache.MaxEntries != 0 {
+			options.MaxEntries = config.Cache.MaxEntries
+		}
+		if config.Cache.MaxBytes != 0 {
+			options.MaxBytes = config.Cache.MaxBytes
+		}
+		if config.Cache.Eviction != "" {
+			options.Eviction = config.Cache.Eviction
+		}
+	}
+	if config.ServeStale != nil && config.ServeStale.Enabled {
+		// Keep expired answers around for as long as they could still be served
+		options.Grace = getStaleOptions(config).maxStale
+	}
+	return options
+}
+
+// getDomainSize estimates the memory a cached answer takes up, including its key
+func getDomainSize(domain *Domain) int64 {
+	return int64(DomainOverhead + 2*len(domain.Name) + len(domain.Ip) + len(domain.Cname) + len(domain.Server))
+}
+
+// readConfig reads the config along with the file's contents, a missing file is an empty config
+func readConfig(file string) (*Config, []byte, error) {
+	data, err := ioutil.ReadFile(file)
 	var config Config
 	if err == nil {
 		err = jsoniter.Unmarshal(data, &config)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	return &config, nil
+	return &config, data, nil
 }
 
 func getJson(url string, target interface{}) error {
@@ -112,13 +336,6 @@ func getJson(url string, target interface{}) error {
 	return json.NewDecoder(r.Body).Decode(target)
 }
 
-func getResultFromDomain(domain *Domain) int8 {
-	if domain.Block {
-		return Block
-	}
-	return Ok
-}
-
 func lookupInMapAndUpdate(items map[string]*Domain, lookup string, updater func(*Domain)) (interface{}, bool) {
 	exact, ok := items[lookup]
 	if ok {
@@ -126,19 +343,27 @@ func lookupInMapAndUpdate(items map[string]*Domain, lookup string, updater func(
 		return exact, true
 	}
 	for key, val := range items {
-		pattern := key
-		if !strings.HasPrefix(pattern, "^") {
-			// Format to be a regex for usage
-			pattern = fmt.Sprintf("^%s$", pattern)
-		}
-		regex, err := regexp.Compile(pattern)
-		if err != nil {
-			continue
+		matches := false
+		if strings.HasPrefix(key, "^") {
+			regex, err := regexp.Compile(key)
+			matches = err == nil && regex.MatchString(lookup)
+		} else {
+			matches = wildcard.Match(key, lookup)
 		}
-		if regex.MatchString(lookup) {
+		if matches {
 			updater(val)
 			//fmt.Printf("Found Match for %s: %s\n", lookup, key)
-			return val, true
+			// The entry is shared by every name the pattern matches, so answer with a copy named as asked
+			return &Domain{
+				Name:     lookup,
+				Time:     val.Time,
+				Ip:       val.Ip,
+				Cname:    val.Cname,
+				Block:    val.Block,
+				Requests: atomic.LoadInt64(&val.Requests),
+				Server:   val.Server,
+				Ttl:      val.Ttl,
+			}, true
 		}
 	}
 	return nil, false
@@ -167,6 +392,23 @@ func getBlockedDomainObj(domainName string) *Domain {
 	}
 }
 
+// getHostDomainObj builds a local host entry, values that are not IPs are CNAME targets
+func getHostDomainObj(domainName string, value interface{}) *Domain {
+	target := fmt.Sprint(value)
+	domain := &Domain{
+		Name:  domainName,
+		Time:  math.MaxInt64,
+		Block: false,
+		Ttl:   math.MaxUint32,
+	}
+	if net.ParseIP(target) != nil {
+		domain.Ip = target
+	} else {
+		domain.Cname = dns.Fqdn(target)
+	}
+	return domain
+}
+
 func getFailedDomainObj(domainName string) *Domain {
 	return &Domain{
 		Ip:       "",
@@ -177,3 +419,30 @@ func getFailedDomainObj(domainName string) *Domain {
 		Server:   NoServer,
 	}
 }
+
+// writeFileAtomic replaces the file in one step, so a crash never leaves it half written
+func writeFileAtomic(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	// Keep the permissions of the file being replaced, rather than those of the temporary file
+	if info, err := os.Stat(file); err == nil {
+		if err = temp.Chmod(info.Mode()); err != nil {
+			_ = temp.Close()
+			return err
+		}
+	}
+	if _, err = temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
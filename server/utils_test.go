@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Downloaded filter lists are used until they are due, then downloaded again, keeping the old copy if that fails
+func TestFilterListRefresh(t *testing.T) {
+	var downloads int64
+	failing := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("||ads.test^\n"))
+		atomic.AddInt64(&downloads, 1)
+	}))
+	defer server.Close()
+	lists := newFilterListCache(logrus.New())
+	lists.configure(&Config{FilterLists: []string{server.URL}})
+
+	read := func() string {
+		reader, err := lists.open(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		data, _ := ioutil.ReadAll(reader)
+		return string(data)
+	}
+	read()
+	read()
+	if downloads != 1 {
+		t.Errorf("expected the list to be downloaded once, it was downloaded %d times", downloads)
+	}
+	lists.refresh = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	read()
+	if downloads != 2 {
+		t.Errorf("expected the list to be downloaded again once it was due, it was downloaded %d times", downloads)
+	}
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(2 * time.Millisecond)
+	if data := read(); data != "||ads.test^\n" {
+		t.Errorf("expected the old copy when the download fails, got %q", data)
+	}
+	lists.configure(&Config{})
+	if len(lists.lists) != 0 {
+		t.Errorf("lists no longer configured should be forgotten")
+	}
+}
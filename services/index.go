@@ -0,0 +1,95 @@
+// Package services is a catalog of well known services
+// and the filter rules needed to block each of them
+package services
+
+import (
+	jsoniter "github.com/json-iterator/go"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Catalog maps a service name to its filter rules
+type Catalog map[string][]string
+
+var builtin = Catalog{
+	"amazon": {"||amazon.com^", "||amazonvideo.com^", "||primevideo.com^", "||media-amazon.com^"},
+	"discord": {"||discord.com^", "||discord.gg^", "||discordapp.com^", "||discordapp.net^",
+		"||discord.media^"},
+	"epicgames": {"||epicgames.com^", "||epicgames.dev^", "||unrealengine.com^", "||fortnite.com^"},
+	"facebook": {"||facebook.com^", "||facebook.net^", "||fbcdn.net^", "||fb.com^", "||fb.me^",
+		"||fbsbx.com^", "||messenger.com^"},
+	"instagram": {"||instagram.com^", "||cdninstagram.com^", "||ig.me^", "||instagr.am^"},
+	"minecraft": {"||minecraft.net^", "||mojang.com^", "||minecraftservices.com^"},
+	"netflix":   {"||netflix.com^", "||netflix.net^", "||nflxext.com^", "||nflximg.com^", "||nflximg.net^", "||nflxso.net^", "||nflxvideo.net^"},
+	"pinterest": {"||pinterest.com^", "||pinimg.com^", "||pin.it^"},
+	"reddit":    {"||reddit.com^", "||redd.it^", "||redditmedia.com^", "||redditstatic.com^"},
+	"roblox":    {"||roblox.com^", "||rbxcdn.com^", "||rbx.com^"},
+	"snapchat": {"||snapchat.com^", "||snap.com^", "||snapads.com^", "||sc-cdn.net^",
+		"||snapkit.co^", "||feelinsonice-hrd.appspot.com^"},
+	"steam": {"||steampowered.com^", "||steamcommunity.com^", "||steamstatic.com^",
+		"||steamcontent.com^", "||steamgames.com^", "||steamusercontent.com^", "||steamserver.net^"},
+	"tiktok": {"||tiktok.com^", "||tiktokv.com^", "||tiktokcdn.com^", "||tiktokcdn-us.com^",
+		"||musical.ly^", "||byteoversea.com^", "||ibytedtos.com^", "||ttwstatic.com^"},
+	"tinder":   {"||tinder.com^", "||gotinder.com^", "||tindersparks.com^"},
+	"twitch":   {"||twitch.tv^", "||twitchcdn.net^", "||twitchsvc.net^", "||jtvnw.net^", "||ttvnw.net^"},
+	"twitter":  {"||twitter.com^", "||twimg.com^", "||t.co^", "||x.com^"},
+	"whatsapp": {"||whatsapp.com^", "||whatsapp.net^", "||wa.me^"},
+	"youtube": {"||youtube.com^", "||ytimg.com^", "||youtu.be^", "||googlevideo.com^",
+		"||youtube-nocookie.com^", "||youtubei.googleapis.com^", "||youtube.googleapis.com^"},
+}
+
+// Builtin returns a copy of the catalog shipped with the server
+func Builtin() Catalog {
+	catalog := make(Catalog)
+	for name, rules := range builtin {
+		catalog[name] = append([]string{}, rules...)
+	}
+	return catalog
+}
+
+// Load reads a JSON file of {"service": ["rule", ...]} on top of the built in catalog.
+// Services in the file replace built in services of the same name
+func Load(path string) (Catalog, error) {
+	catalog := Builtin()
+	if path == "" {
+		return catalog, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return catalog, err
+	}
+	var overrides Catalog
+	if err := jsoniter.Unmarshal(data, &overrides); err != nil {
+		return catalog, err
+	}
+	for name, rules := range overrides {
+		catalog[strings.ToLower(name)] = rules
+	}
+	return catalog, nil
+}
+
+// Rules collects the rules for the named services, along with any names that are not in the catalog
+func (this Catalog) Rules(names []string) ([]string, []string) {
+	rules := make([]string, 0)
+	unknown := make([]string, 0)
+	for _, name := range names {
+		serviceRules, ok := this[strings.ToLower(name)]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		rules = append(rules, serviceRules...)
+	}
+	return rules, unknown
+}
+
+// Names lists every service in the catalog, sorted
+func (this Catalog) Names() []string {
+	names := make([]string, 0, len(this))
+	for name := range this {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Flight makes sure only one call per key is running at a time.
+// Callers that arrive while a call is in flight wait for it and share its result
+type Flight struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+func NewFlight() *Flight {
+	return &Flight{calls: make(map[string]*flightCall)}
+}
+
+// Do runs fn for the key, or waits for the call already running for it.
+// shared is true when the result came from another caller's call
+func (this *Flight) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	this.mutex.Lock()
+	if call, ok := this.calls[key]; ok {
+		this.mutex.Unlock()
+		call.done.Wait()
+		return call.value, call.err, true
+	}
+	call := &flightCall{}
+	call.done.Add(1)
+	this.calls[key] = call
+	this.mutex.Unlock()
+
+	defer func() {
+		this.mutex.Lock()
+		delete(this.calls, key)
+		this.mutex.Unlock()
+		call.done.Done()
+	}()
+	call.value, call.err = run(fn)
+	return call.value, call.err, false
+}
+
+// run calls fn, turning a panic into an error, so the caller and everyone waiting on it get a result
+func run(fn func() (interface{}, error)) (value interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			value, err = nil, fmt.Errorf("lookup failed: %v", recovered)
+		}
+	}()
+	return fn()
+}